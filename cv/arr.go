@@ -1,14 +1,16 @@
 package cv
 
-// #include "cv.h"
+// #include "shim.h"
 import "C"
 
 import (
+	"errors"
+	"fmt"
 	"unsafe"
 )
 
-// Arr is the interface that wraps any image-like surface. IplImage and Seq
-// implement this interface.
+// Arr is the interface that wraps any image-like surface. IplImage, Mat, MatND,
+// SparseMat and Seq implement this interface.
 type Arr interface {
 	Size() Size
 	arr() unsafe.Pointer
@@ -16,28 +18,367 @@ type Arr interface {
 
 // Copy copies elements from src to dst. If mask is not nil, then only elements
 // that have a non-zero mask element will be copied.
-func Copy(src, dst, mask Arr) {
-	do(func() {
+func Copy(src, dst, mask Arr) error {
+	mustMatch("Copy", "src", "dst", src, dst)
+	mustMask("Copy", mask, "src", src)
+	return doErr(func() error {
 		if mask == nil {
-			C.cvCopy(src.arr(), dst.arr(), nil)
+			C.try_cvCopy(src.arr(), dst.arr(), nil)
 		} else {
-			C.cvCopy(src.arr(), dst.arr(), mask.arr())
+			C.try_cvCopy(src.arr(), dst.arr(), mask.arr())
 		}
+		return nil
 	})
 }
 
 // ConvertScale converts from src to dst.  Each element is multiplied by scale
 // then increased by shift.
-func ConvertScale(src, dst Arr, scale, shift float64) {
-	do(func() {
-		C.cvConvertScale(src.arr(), dst.arr(), C.double(scale), C.double(shift))
+func ConvertScale(src, dst Arr, scale, shift float64) error {
+	mustArr("ConvertScale", "src", src)
+	mustArr("ConvertScale", "dst", dst)
+	mustSameSize("ConvertScale", "src", "dst", src, dst)
+	mustSameChannels("ConvertScale", "src", "dst", src, dst)
+	return doErr(func() error {
+		C.try_cvConvertScale(src.arr(), dst.arr(), C.double(scale), C.double(shift))
+		return nil
 	})
 }
 
-// SetData copies bytes into the array.  Usually an IplImage's data will be
-// packed in interleaved BGR order.  widthStep is the number of bytes per row.
-func SetData(arr Arr, data []byte, widthStep int) {
-	do(func() {
-		C.cvSetData(arr.arr(), unsafe.Pointer(&data[0]), C.int(widthStep))
+// SetData makes arr use data as its elements without copying it.  Usually an
+// IplImage's data will be packed in interleaved BGR order.  arr must be an
+// *IplImage or a *Mat.  widthStep is the number of bytes per row of data, which
+// must hold at least height*widthStep bytes.  data is kept alive and pinned
+// until arr is released, and it must not be resized or reused in the meantime.
+func SetData(arr Arr, data []byte, widthStep int) error {
+	if isNilArr(arr) {
+		return errors.New("cv: SetData: array is nil or released")
+	}
+	switch arr := arr.(type) {
+	case *IplImage:
+		return arr.setData(data, widthStep)
+	case *Mat:
+		return arr.setData(data, widthStep)
+	}
+	return errors.New("cv: SetData: only images and matrices can use Go memory")
+}
+
+// Get1D returns the element at idx0 of arr, treating arr as a one-dimensional
+// array in row-major order.
+func Get1D(arr Arr, idx0 int) (Scalar, error) {
+	var s C.CvScalar
+	err := doErr(func() error {
+		if err := checkLinearIndex(arr, idx0); err != nil {
+			return err
+		}
+		s = C.try_cvGet1D(arr.arr(), C.int(idx0))
+		return nil
+	})
+	return scalarFromC(s), err
+}
+
+// Get2D returns the element of a two-dimensional arr.  For images and
+// matrices, idx0 is the row (y) and idx1 is the column (x).
+func Get2D(arr Arr, idx0, idx1 int) (Scalar, error) {
+	var s C.CvScalar
+	err := doErr(func() error {
+		if err := checkIndex(arr, idx0, idx1); err != nil {
+			return err
+		}
+		s = C.try_cvGet2D(arr.arr(), C.int(idx0), C.int(idx1))
+		return nil
+	})
+	return scalarFromC(s), err
+}
+
+// Get3D returns the element of a three-dimensional arr.
+func Get3D(arr Arr, idx0, idx1, idx2 int) (Scalar, error) {
+	var s C.CvScalar
+	err := doErr(func() error {
+		if err := checkIndex(arr, idx0, idx1, idx2); err != nil {
+			return err
+		}
+		s = C.try_cvGet3D(arr.arr(), C.int(idx0), C.int(idx1), C.int(idx2))
+		return nil
+	})
+	return scalarFromC(s), err
+}
+
+// GetND returns the element of arr at idx, which must have one index for each
+// of arr's dimensions.
+func GetND(arr Arr, idx []int) (Scalar, error) {
+	var s C.CvScalar
+	cidx := cIndex(idx)
+	err := doErr(func() error {
+		if err := checkIndex(arr, idx...); err != nil {
+			return err
+		}
+		s = C.try_cvGetND(arr.arr(), &cidx[0])
+		return nil
+	})
+	return scalarFromC(s), err
+}
+
+// GetReal1D is like Get1D, but for single-channel arrays.
+func GetReal1D(arr Arr, idx0 int) (float64, error) {
+	var v C.double
+	err := doErr(func() error {
+		if err := checkSingleChannel(arr); err != nil {
+			return err
+		}
+		if err := checkLinearIndex(arr, idx0); err != nil {
+			return err
+		}
+		v = C.try_cvGetReal1D(arr.arr(), C.int(idx0))
+		return nil
+	})
+	return float64(v), err
+}
+
+// GetReal2D is like Get2D, but for single-channel arrays.
+func GetReal2D(arr Arr, idx0, idx1 int) (float64, error) {
+	var v C.double
+	err := doErr(func() error {
+		if err := checkSingleChannel(arr); err != nil {
+			return err
+		}
+		if err := checkIndex(arr, idx0, idx1); err != nil {
+			return err
+		}
+		v = C.try_cvGetReal2D(arr.arr(), C.int(idx0), C.int(idx1))
+		return nil
+	})
+	return float64(v), err
+}
+
+// GetReal3D is like Get3D, but for single-channel arrays.
+func GetReal3D(arr Arr, idx0, idx1, idx2 int) (float64, error) {
+	var v C.double
+	err := doErr(func() error {
+		if err := checkSingleChannel(arr); err != nil {
+			return err
+		}
+		if err := checkIndex(arr, idx0, idx1, idx2); err != nil {
+			return err
+		}
+		v = C.try_cvGetReal3D(arr.arr(), C.int(idx0), C.int(idx1), C.int(idx2))
+		return nil
+	})
+	return float64(v), err
+}
+
+// GetRealND is like GetND, but for single-channel arrays.
+func GetRealND(arr Arr, idx []int) (float64, error) {
+	var v C.double
+	cidx := cIndex(idx)
+	err := doErr(func() error {
+		if err := checkSingleChannel(arr); err != nil {
+			return err
+		}
+		if err := checkIndex(arr, idx...); err != nil {
+			return err
+		}
+		v = C.try_cvGetRealND(arr.arr(), &cidx[0])
+		return nil
+	})
+	return float64(v), err
+}
+
+// Set1D changes the element at idx0 of arr, treating arr as a one-dimensional
+// array in row-major order.
+func Set1D(arr Arr, idx0 int, value Scalar) error {
+	err := doErr(func() error {
+		if err := checkLinearIndex(arr, idx0); err != nil {
+			return err
+		}
+		C.try_cvSet1D(arr.arr(), C.int(idx0), value.cvScalar())
+		return nil
+	})
+	return err
+}
+
+// Set2D changes an element of a two-dimensional arr.  For images and matrices,
+// idx0 is the row (y) and idx1 is the column (x).
+func Set2D(arr Arr, idx0, idx1 int, value Scalar) error {
+	err := doErr(func() error {
+		if err := checkIndex(arr, idx0, idx1); err != nil {
+			return err
+		}
+		C.try_cvSet2D(arr.arr(), C.int(idx0), C.int(idx1), value.cvScalar())
+		return nil
+	})
+	return err
+}
+
+// Set3D changes an element of a three-dimensional arr.
+func Set3D(arr Arr, idx0, idx1, idx2 int, value Scalar) error {
+	err := doErr(func() error {
+		if err := checkIndex(arr, idx0, idx1, idx2); err != nil {
+			return err
+		}
+		C.try_cvSet3D(arr.arr(), C.int(idx0), C.int(idx1), C.int(idx2), value.cvScalar())
+		return nil
 	})
+	return err
+}
+
+// SetND changes the element of arr at idx, which must have one index for each
+// of arr's dimensions.
+func SetND(arr Arr, idx []int, value Scalar) error {
+	cidx := cIndex(idx)
+	err := doErr(func() error {
+		if err := checkIndex(arr, idx...); err != nil {
+			return err
+		}
+		C.try_cvSetND(arr.arr(), &cidx[0], value.cvScalar())
+		return nil
+	})
+	return err
+}
+
+// SetReal1D is like Set1D, but for single-channel arrays.
+func SetReal1D(arr Arr, idx0 int, value float64) error {
+	err := doErr(func() error {
+		if err := checkSingleChannel(arr); err != nil {
+			return err
+		}
+		if err := checkLinearIndex(arr, idx0); err != nil {
+			return err
+		}
+		C.try_cvSetReal1D(arr.arr(), C.int(idx0), C.double(value))
+		return nil
+	})
+	return err
+}
+
+// SetReal2D is like Set2D, but for single-channel arrays.
+func SetReal2D(arr Arr, idx0, idx1 int, value float64) error {
+	err := doErr(func() error {
+		if err := checkSingleChannel(arr); err != nil {
+			return err
+		}
+		if err := checkIndex(arr, idx0, idx1); err != nil {
+			return err
+		}
+		C.try_cvSetReal2D(arr.arr(), C.int(idx0), C.int(idx1), C.double(value))
+		return nil
+	})
+	return err
+}
+
+// SetReal3D is like Set3D, but for single-channel arrays.
+func SetReal3D(arr Arr, idx0, idx1, idx2 int, value float64) error {
+	err := doErr(func() error {
+		if err := checkSingleChannel(arr); err != nil {
+			return err
+		}
+		if err := checkIndex(arr, idx0, idx1, idx2); err != nil {
+			return err
+		}
+		C.try_cvSetReal3D(arr.arr(), C.int(idx0), C.int(idx1), C.int(idx2), C.double(value))
+		return nil
+	})
+	return err
+}
+
+// SetRealND is like SetND, but for single-channel arrays.
+func SetRealND(arr Arr, idx []int, value float64) error {
+	cidx := cIndex(idx)
+	err := doErr(func() error {
+		if err := checkSingleChannel(arr); err != nil {
+			return err
+		}
+		if err := checkIndex(arr, idx...); err != nil {
+			return err
+		}
+		C.try_cvSetRealND(arr.arr(), &cidx[0], C.double(value))
+		return nil
+	})
+	return err
+}
+
+// cIndex converts idx to C ints.  The result always has at least one element
+// so that it can be passed to C even if idx is empty.
+func cIndex(idx []int) []C.int {
+	cidx := make([]C.int, len(idx)+1)
+	for i := range idx {
+		cidx[i] = C.int(idx[i])
+	}
+	return cidx
+}
+
+// arrDims returns the size of each of arr's dimensions.  It must be called
+// from doErr.
+func arrDims(arr Arr) ([]int, error) {
+	if isNilArr(arr) {
+		return nil, errors.New("cv: array is nil or released")
+	}
+	if _, ok := arr.(Seq); ok {
+		return nil, errors.New("cv: element access is not supported on sequences")
+	}
+	if img, ok := arr.(*IplImage); ok {
+		// cvGetDims reports the whole image, but elements are addressed
+		// relative to the region of interest.
+		bd := img.Bounds()
+		return []int{bd.Dy(), bd.Dx()}, nil
+	}
+	var sizes [C.CV_MAX_DIM]C.int
+	n := int(C.try_cvGetDims(arr.arr(), &sizes[0]))
+	if e := takeError(); e != nil {
+		return nil, e
+	}
+	dims := make([]int, n)
+	for i := range dims {
+		dims[i] = int(sizes[i])
+	}
+	return dims, nil
+}
+
+// checkIndex returns an error if idx does not address an element of arr.  It
+// must be called from doErr.
+func checkIndex(arr Arr, idx ...int) error {
+	dims, err := arrDims(arr)
+	if err != nil {
+		return err
+	}
+	if len(idx) != len(dims) {
+		return fmt.Errorf("cv: %d indices given for %d-dimensional array", len(idx), len(dims))
+	}
+	for i := range idx {
+		if idx[i] < 0 || idx[i] >= dims[i] {
+			return fmt.Errorf("cv: index %v out of range for array of size %v", idx, dims)
+		}
+	}
+	return nil
+}
+
+// checkLinearIndex returns an error if idx0 is not a row-major index of an
+// element of arr.  It must be called from doErr.
+func checkLinearIndex(arr Arr, idx0 int) error {
+	dims, err := arrDims(arr)
+	if err != nil {
+		return err
+	}
+	if idx0 < 0 || idx0 >= totalSize(dims) {
+		return fmt.Errorf("cv: index %d out of range for array of size %v", idx0, dims)
+	}
+	return nil
+}
+
+// checkSingleChannel returns an error if arr has more than one channel.  It
+// must be called from doErr.
+func checkSingleChannel(arr Arr) error {
+	if isNilArr(arr) {
+		return errors.New("cv: array is nil or released")
+	}
+	if _, ok := arr.(Seq); ok {
+		return errors.New("cv: element access is not supported on sequences")
+	}
+	t := MatType(C.try_cvGetElemType(arr.arr()))
+	if e := takeError(); e != nil {
+		return e
+	}
+	if n := t.Channels(); n != 1 {
+		return fmt.Errorf("cv: array has %d channels, expected 1", n)
+	}
+	return nil
 }
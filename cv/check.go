@@ -0,0 +1,232 @@
+package cv
+
+// #include "cv.h"
+import "C"
+
+import (
+	"fmt"
+)
+
+// The functions in this file check arguments before they are passed to
+// OpenCV, which crashes or corrupts memory on many bad inputs instead of
+// reporting an error.  They only look at Go-side headers, so they can be
+// called from any goroutine.  The must* functions panic with a message naming
+// the function and argument; the rest report what they found.
+
+// isNilArr reports whether arr has nothing to pass to OpenCV: a nil
+// interface, a nil pointer, an array that has been released or a zero Seq.
+func isNilArr(arr Arr) bool {
+	switch a := arr.(type) {
+	case nil:
+		return true
+	case *IplImage:
+		return a == nil || a.ipl == nil
+	case *Mat:
+		return a == nil || a.m == nil
+	case *MatND:
+		return a == nil || a.m == nil
+	case *SparseMat:
+		return a == nil || a.m == nil
+	case Seq:
+		return a.seq == nil
+	}
+	return false
+}
+
+// depthTypes maps image depths to single-channel matrix types.
+var depthTypes = map[Depth]MatType{
+	IPL_DEPTH_8U:  CV_8UC1,
+	IPL_DEPTH_8S:  CV_8SC1,
+	IPL_DEPTH_16U: CV_16UC1,
+	IPL_DEPTH_16S: CV_16SC1,
+	IPL_DEPTH_32S: CV_32SC1,
+	IPL_DEPTH_32F: CV_32FC1,
+	IPL_DEPTH_64F: CV_64FC1,
+}
+
+// arrType returns the element type of a non-nil arr.  ok is false if the type
+// isn't known without asking OpenCV, as for sequences and images with a
+// channel of interest.
+func arrType(arr Arr) (typ MatType, ok bool) {
+	switch a := arr.(type) {
+	case *IplImage:
+		if a.ipl.roi != nil && a.ipl.roi.coi != 0 {
+			return 0, false
+		}
+		typ, ok = depthTypes[a.Depth()]
+		return typ.withChannels(a.NChannels()), ok
+	case *Mat:
+		return a.Type(), true
+	case *MatND:
+		return a.Type(), true
+	case *SparseMat:
+		return a.Type(), true
+	}
+	return 0, false
+}
+
+// arrSize returns the size of a non-nil arr, using the region of interest for
+// images.  ok is false for sequences.
+func arrSize(arr Arr) (size Size, ok bool) {
+	switch a := arr.(type) {
+	case *IplImage:
+		if roi := a.ipl.roi; roi != nil {
+			return Size{int(roi.width), int(roi.height)}, true
+		}
+		return Size{a.Width(), a.Height()}, true
+	case *Mat, *MatND, *SparseMat:
+		return a.Size(), true
+	}
+	return Size{}, false
+}
+
+// typeDepth returns the depth part of t.
+func typeDepth(t MatType) int {
+	return int(t) & C.CV_MAT_DEPTH_MASK
+}
+
+// depthName returns the name of the depth part of t, like "8U".
+func depthName(t MatType) string {
+	return [...]string{"8U", "8S", "16U", "16S", "32S", "32F", "64F", "USRTYPE1"}[typeDepth(t)]
+}
+
+// mustArr panics if arr is nil or released.
+func mustArr(fn, name string, arr Arr) {
+	if isNilArr(arr) {
+		panic(fmt.Sprintf("cv: %s: %s is nil or released", fn, name))
+	}
+}
+
+// mustStorage panics if s is nil or released.
+func mustStorage(fn string, s *MemStorage) {
+	if s == nil || s.s == nil {
+		panic(fmt.Sprintf("cv: %s: storage is nil or released", fn))
+	}
+}
+
+// mustSeq panics if s is a zero Seq.
+func mustSeq(fn, name string, s Seq) {
+	if s.seq == nil {
+		panic(fmt.Sprintf("cv: %s: %s is a zero Seq", fn, name))
+	}
+}
+
+// mustSameSize panics if the sizes of a and b are known and differ.
+func mustSameSize(fn, aName, bName string, a, b Arr) {
+	as, aok := arrSize(a)
+	bs, bok := arrSize(b)
+	if aok && bok && as != bs {
+		panic(fmt.Sprintf("cv: %s: %s is %dx%d but %s is %dx%d", fn, aName, as.Width, as.Height, bName, bs.Width, bs.Height))
+	}
+}
+
+// mustHalfSize panics if the sizes of src and dst are known and dst is not half
+// the size of src.  Like OpenCV, it allows each dimension of dst to be rounded
+// either way.
+func mustHalfSize(fn string, src, dst Arr) {
+	s, sok := arrSize(src)
+	d, dok := arrSize(dst)
+	if sok && dok && (abs(d.Width*2-s.Width) > 2 || abs(d.Height*2-s.Height) > 2) {
+		panic(fmt.Sprintf("cv: %s: dst is %dx%d, want half of src's %dx%d", fn, d.Width, d.Height, s.Width, s.Height))
+	}
+}
+
+// mustDoubleSize panics if the sizes of src and dst are known and dst is not
+// twice the size of src.  Like OpenCV, it allows odd dimensions of dst to be
+// one more or less.
+func mustDoubleSize(fn string, src, dst Arr) {
+	s, sok := arrSize(src)
+	d, dok := arrSize(dst)
+	if sok && dok && (abs(d.Width-s.Width*2) != d.Width%2 || abs(d.Height-s.Height*2) != d.Height%2) {
+		panic(fmt.Sprintf("cv: %s: dst is %dx%d, want twice src's %dx%d", fn, d.Width, d.Height, s.Width, s.Height))
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+// mustSameType panics if the element types of a and b are known and differ.
+func mustSameType(fn, aName, bName string, a, b Arr) {
+	mustSameChannels(fn, aName, bName, a, b)
+	mustSameDepth(fn, aName, bName, a, b)
+}
+
+// mustSameChannels panics if the channel counts of a and b are known and
+// differ.
+func mustSameChannels(fn, aName, bName string, a, b Arr) {
+	at, aok := arrType(a)
+	bt, bok := arrType(b)
+	if aok && bok && at.Channels() != bt.Channels() {
+		panic(fmt.Sprintf("cv: %s: %s has %d channels but %s has %d", fn, aName, at.Channels(), bName, bt.Channels()))
+	}
+}
+
+// mustSameDepth panics if the depths of a and b are known and differ.
+func mustSameDepth(fn, aName, bName string, a, b Arr) {
+	at, aok := arrType(a)
+	bt, bok := arrType(b)
+	if aok && bok && typeDepth(at) != typeDepth(bt) {
+		panic(fmt.Sprintf("cv: %s: %s has depth %s but %s has depth %s", fn, aName, depthName(at), bName, depthName(bt)))
+	}
+}
+
+// mustChannels panics if the channel count of arr is known and is not n.
+func mustChannels(fn, name string, arr Arr, n int) {
+	if t, ok := arrType(arr); ok && t.Channels() != n {
+		panic(fmt.Sprintf("cv: %s: %s has %d channels, want %d", fn, name, t.Channels(), n))
+	}
+}
+
+// mustDepth panics if the depth of arr is known and is not one of depths, like
+// CV_8U.
+func mustDepth(fn, name string, arr Arr, depths ...int) {
+	t, ok := arrType(arr)
+	if !ok {
+		return
+	}
+	for _, d := range depths {
+		if typeDepth(t) == d {
+			return
+		}
+	}
+	panic(fmt.Sprintf("cv: %s: %s has depth %s, which is not supported", fn, name, depthName(t)))
+}
+
+// mustType panics if the element type of arr is known and is not one of
+// types.
+func mustType(fn, name string, arr Arr, types ...MatType) {
+	t, ok := arrType(arr)
+	if !ok {
+		return
+	}
+	for _, want := range types {
+		if t == want {
+			return
+		}
+	}
+	panic(fmt.Sprintf("cv: %s: %s has %d channels of depth %s, which is not supported", fn, name, t.Channels(), depthName(t)))
+}
+
+// mustMask panics if mask is not nil and is not an 8-bit single-channel array
+// the same size as arr.
+func mustMask(fn string, mask Arr, name string, arr Arr) {
+	if mask == nil {
+		return
+	}
+	mustArr(fn, "mask", mask)
+	mustType(fn, "mask", mask, CV_8UC1, CV_8SC1)
+	mustSameSize(fn, "mask", name, mask, arr)
+}
+
+// mustMatch panics unless a and b are not nil and have the same size and
+// element type.
+func mustMatch(fn, aName, bName string, a, b Arr) {
+	mustArr(fn, aName, a)
+	mustArr(fn, bName, b)
+	mustSameSize(fn, aName, bName, a, b)
+	mustSameType(fn, aName, bName, a, b)
+}
@@ -1,10 +1,11 @@
 package cv
 
-// #include "cv.h"
+// #include "shim.h"
 import "C"
 
 import (
 	"errors"
+	"fmt"
 	"unsafe"
 )
 
@@ -29,15 +30,23 @@ const (
 // FindContours finds contour lines in a 8-bit, single-channel image. The
 // recommended mode and method are RETR_LIST and CHAIN_APPROX_SIMPLE.  offset is
 // added to every point in the contour.
-func FindContours(image Arr, storage MemStorage, mode, method int, offset Point) (Seq, error) {
-	var seq Seq
-	var result C.int
-	do(func() {
-		result = C.cvFindContours(image.arr(), storage.s, &seq.seq, C.sizeof_CvContour, C.int(mode), C.int(method), C.CvPoint{C.int(offset.X), C.int(offset.Y)})
+func FindContours(image Arr, storage *MemStorage, mode, method int, offset Point) (Seq, error) {
+	if isNilArr(image) {
+		return Seq{}, errors.New("cv: FindContours: image is nil or released")
+	}
+	if t, ok := arrType(image); ok && t != CV_8UC1 && t != CV_32SC1 {
+		return Seq{}, fmt.Errorf("cv: FindContours: image has %d channels of depth %s, want 8-bit single-channel", t.Channels(), depthName(t))
+	}
+	if storage == nil || storage.s == nil {
+		return Seq{}, errors.New("cv: FindContours: storage is nil or released")
+	}
+	seq := Seq{storage: storage}
+	err := doErr(func() error {
+		C.try_cvFindContours(image.arr(), storage.s, &seq.seq, C.sizeof_CvContour, C.int(mode), C.int(method), C.CvPoint{C.int(offset.X), C.int(offset.Y)})
+		return nil
 	})
-	if result < 0 {
-		// TODO: Get error string
-		return Seq{}, errors.New("FindContours failed")
+	if err != nil {
+		return Seq{}, err
 	}
 	return seq, nil
 }
@@ -50,17 +59,24 @@ const (
 // ApproxPoly approximates polygonal curves. POLY_APPROX_DP is the only method
 // supported. parameter is the desired approximation accuracy. parameter2
 // should be zero to indicate only the given contour.
-func ApproxPoly(srcSeq Seq, storage MemStorage, method int, parameter float64, parameter2 int) Seq {
-	var seq Seq
-	do(func() {
-		seq = Seq{C.cvApproxPoly(unsafe.Pointer(srcSeq.seq), C.sizeof_CvContour, storage.s, C.int(method), C.double(parameter), C.int(parameter2))}
+func ApproxPoly(srcSeq Seq, storage *MemStorage, method int, parameter float64, parameter2 int) (Seq, error) {
+	mustSeq("ApproxPoly", "srcSeq", srcSeq)
+	mustStorage("ApproxPoly", storage)
+	seq := Seq{storage: storage}
+	err := doErr(func() error {
+		seq.seq = C.try_cvApproxPoly(unsafe.Pointer(srcSeq.seq), C.sizeof_CvContour, storage.s, C.int(method), C.double(parameter), C.int(parameter2))
+		return nil
 	})
-	return seq
+	if err != nil {
+		return Seq{}, err
+	}
+	return seq, nil
 }
 
 // ContourArea returns the area inside contour. If oriented is true, then a
 // negative area is returned if the contour is counter-clockwise.
-func ContourArea(contour Arr, slice Slice, oriented bool) float64 {
+func ContourArea(contour Arr, slice Slice, oriented bool) (float64, error) {
+	mustArr("ContourArea", "contour", contour)
 	var corient C.int
 	if oriented {
 		corient = 1
@@ -68,25 +84,28 @@ func ContourArea(contour Arr, slice Slice, oriented bool) float64 {
 		corient = 0
 	}
 	var area float64
-	do(func() {
-		area = float64(C.cvContourArea(contour.arr(), C.CvSlice{C.int(slice.Start), C.int(slice.End)}, corient))
+	err := doErr(func() error {
+		area = float64(C.try_cvContourArea(contour.arr(), C.CvSlice{C.int(slice.Start), C.int(slice.End)}, corient))
+		return nil
 	})
-	return area
+	return area, err
 }
 
 // ArcLength returns the length of the contour. If isClosed is negative, then
 // the contour is checked to see whether the contour should be considered
 // closed.  If isClosed is zero or one, then it overrides the contour's flags.
-func ArcLength(contour Arr, slice Slice, isClosed int) float64 {
+func ArcLength(contour Arr, slice Slice, isClosed int) (float64, error) {
+	mustArr("ArcLength", "contour", contour)
 	var length float64
-	do(func() {
-		length = float64(C.cvArcLength(contour.arr(), C.CvSlice{C.int(slice.Start), C.int(slice.End)}, C.int(isClosed)))
+	err := doErr(func() error {
+		length = float64(C.try_cvArcLength(contour.arr(), C.CvSlice{C.int(slice.Start), C.int(slice.End)}, C.int(isClosed)))
+		return nil
 	})
-	return length
+	return length, err
 }
 
 // ContourPerimeter returns the length of a closed contour.
-func ContourPerimeter(contour Arr) float64 {
+func ContourPerimeter(contour Arr) (float64, error) {
 	return ArcLength(contour, WHOLE_SEQ, 1)
 }
 
@@ -98,28 +117,41 @@ const (
 )
 
 // Returns the ConvexHull of the contour, removing any concavity
-func ConvexHull(contour Arr, orientation Orientation, returnPoints int) Seq {
+func ConvexHull(contour Arr, orientation Orientation, returnPoints int) (Seq, error) {
+	mustArr("ConvexHull", "contour", contour)
 	var seq Seq
-	do(func() {
-		seq = Seq{C.cvConvexHull2(contour.arr(), nil, C.int(orientation), C.int(returnPoints))}
+	if s, ok := contour.(Seq); ok {
+		// The hull is allocated from the contour's storage.
+		seq.storage = s.storage
+	}
+	err := doErr(func() error {
+		seq.seq = C.try_cvConvexHull2(contour.arr(), nil, C.int(orientation), C.int(returnPoints))
+		return nil
 	})
-	return seq
+	if err != nil {
+		return Seq{}, err
+	}
+	return seq, nil
 }
 
 // CheckContourConvexity returns true if the contour is convex.
-func CheckContourConvexity(contour Arr) bool {
+func CheckContourConvexity(contour Arr) (bool, error) {
+	mustArr("CheckContourConvexity", "contour", contour)
 	var result C.int
-	do(func() {
-		result = C.cvCheckContourConvexity(contour.arr())
+	err := doErr(func() error {
+		result = C.try_cvCheckContourConvexity(contour.arr())
+		return nil
 	})
-	return result != 0
+	return result != 0, err
 }
 
 // returns the approximation of contour as a Rect
-func BoundingRect(contour Arr) Rect {
-	var rect C.struct_CvRect
-	do(func() {
-		rect = C.cvBoundingRect(contour.arr(), C.int(0))
+func BoundingRect(contour Arr) (Rect, error) {
+	mustArr("BoundingRect", "contour", contour)
+	var rect C.CvRect
+	err := doErr(func() error {
+		rect = C.try_cvBoundingRect(contour.arr(), C.int(0))
+		return nil
 	})
-	return Rect{X: int(rect.x), Y: int(rect.y), Width: int(rect.width), Height: int(rect.height)}
+	return Rect{X: int(rect.x), Y: int(rect.y), Width: int(rect.width), Height: int(rect.height)}, err
 }
@@ -1,16 +1,41 @@
 /*
 	Package cv provides idiomatic bindings to OpenCV.
+
+	OpenCV has issues with multiple threads, so by default every call is made
+	from a single OS thread.  SetWorkers allows calls that don't need the main
+	thread to run in parallel instead.  Programs that use HighGUI windows must
+	serve calls from the main thread by calling Main or Run from their main
+	function:
+
+		func main() {
+			cv.Run(func() {
+				// Use the package here.
+			})
+		}
+
+	Tests and libraries that don't need windows can call Start instead:
+
+		func TestMain(m *testing.M) {
+			cv.Start()
+			os.Exit(m.Run())
+		}
+
+	Errors that OpenCV reports during a call are returned as *Error by the
+	functions that return an error, instead of aborting the process.  Arguments
+	that OpenCV can't report safely, like nil arrays or arrays whose sizes or
+	element types don't match, cause a panic before any OpenCV call is made.
 */
 package cv
 
 // #cgo CFLAGS: -Wno-error
 // #cgo !windows pkg-config: opencv
-// #cgo windows CFLAGS: -IC:/opencv/build/include -IC:/opencv/build/include/opencv -IC:/opencv/build/include/opencv2
+// #cgo windows CPPFLAGS: -IC:/opencv/build/include -IC:/opencv/build/include/opencv -IC:/opencv/build/include/opencv2
 // #cgo windows LDFLAGS: -LC:/opencv/build/x86/vc11/bin -lopencv_calib3d2411 -lopencv_contrib2411 -lopencv_core2411 -lopencv_features2d2411 -lopencv_flann2411 -lopencv_gpu2411 -lopencv_highgui2411 -lopencv_imgproc2411 -lopencv_legacy2411 -lopencv_ml2411 -lopencv_nonfree2411 -lopencv_objdetect2411 -lopencv_photo2411 -lopencv_stitching2411 -lopencv_video2411 -lopencv_videostab2411 -lopencv_ffmpeg2411
-// #include "cv.h"
+// #include "shim.h"
 import "C"
 
 import (
+	"fmt"
 	"unsafe"
 )
 
@@ -71,25 +96,322 @@ func (s Scalar) cvScalar() C.CvScalar {
 	return C.CvScalar{[4]C.double{C.double(s[0]), C.double(s[1]), C.double(s[2]), C.double(s[3])}}
 }
 
+func scalarFromC(s C.CvScalar) Scalar {
+	return Scalar{float64(s.val[0]), float64(s.val[1]), float64(s.val[2]), float64(s.val[3])}
+}
+
 // And performs a bitwise AND on src1 and src2 and stores into dst.
-func And(src1, src2, dst, mask Arr) {
-	do(func() {
+func And(src1, src2, dst, mask Arr) error {
+	mustMatch("And", "src1", "src2", src1, src2)
+	mustMatch("And", "src1", "dst", src1, dst)
+	mustMask("And", mask, "src1", src1)
+	return doErr(func() error {
 		if mask != nil {
-			C.cvAnd(src1.arr(), src2.arr(), dst.arr(), mask.arr())
+			C.try_cvAnd(src1.arr(), src2.arr(), dst.arr(), mask.arr())
 		} else {
-			C.cvAnd(src1.arr(), src2.arr(), dst.arr(), nil)
+			C.try_cvAnd(src1.arr(), src2.arr(), dst.arr(), nil)
 		}
+		return nil
 	})
 }
 
 // Or performs a bitwise OR on src1 and src2 and stores into dst
-func Or(src1, src2, dst, mask Arr) {
-	do(func() {
+func Or(src1, src2, dst, mask Arr) error {
+	mustMatch("Or", "src1", "src2", src1, src2)
+	mustMatch("Or", "src1", "dst", src1, dst)
+	mustMask("Or", mask, "src1", src1)
+	return doErr(func() error {
+		if mask != nil {
+			C.try_cvOr(src1.arr(), src2.arr(), dst.arr(), mask.arr())
+		} else {
+			C.try_cvOr(src1.arr(), src2.arr(), dst.arr(), nil)
+		}
+		return nil
+	})
+}
+
+// Xor performs a bitwise XOR on src1 and src2 and stores into dst.
+func Xor(src1, src2, dst, mask Arr) error {
+	mustMatch("Xor", "src1", "src2", src1, src2)
+	mustMatch("Xor", "src1", "dst", src1, dst)
+	mustMask("Xor", mask, "src1", src1)
+	return doErr(func() error {
+		if mask != nil {
+			C.try_cvXor(src1.arr(), src2.arr(), dst.arr(), mask.arr())
+		} else {
+			C.try_cvXor(src1.arr(), src2.arr(), dst.arr(), nil)
+		}
+		return nil
+	})
+}
+
+// Not inverts every bit of src and stores into dst.
+func Not(src, dst Arr) error {
+	mustMatch("Not", "src", "dst", src, dst)
+	return doErr(func() error {
+		C.try_cvNot(src.arr(), dst.arr())
+		return nil
+	})
+}
+
+// AndS performs a bitwise AND on each element of src and value and stores into
+// dst.  Floating-point values are converted to the array's depth first.
+func AndS(src Arr, value Scalar, dst, mask Arr) error {
+	mustMatch("AndS", "src", "dst", src, dst)
+	mustMask("AndS", mask, "src", src)
+	return doErr(func() error {
+		if mask != nil {
+			C.try_cvAndS(src.arr(), value.cvScalar(), dst.arr(), mask.arr())
+		} else {
+			C.try_cvAndS(src.arr(), value.cvScalar(), dst.arr(), nil)
+		}
+		return nil
+	})
+}
+
+// OrS performs a bitwise OR on each element of src and value and stores into
+// dst.
+func OrS(src Arr, value Scalar, dst, mask Arr) error {
+	mustMatch("OrS", "src", "dst", src, dst)
+	mustMask("OrS", mask, "src", src)
+	return doErr(func() error {
+		if mask != nil {
+			C.try_cvOrS(src.arr(), value.cvScalar(), dst.arr(), mask.arr())
+		} else {
+			C.try_cvOrS(src.arr(), value.cvScalar(), dst.arr(), nil)
+		}
+		return nil
+	})
+}
+
+// XorS performs a bitwise XOR on each element of src and value and stores into
+// dst.
+func XorS(src Arr, value Scalar, dst, mask Arr) error {
+	mustMatch("XorS", "src", "dst", src, dst)
+	mustMask("XorS", mask, "src", src)
+	return doErr(func() error {
+		if mask != nil {
+			C.try_cvXorS(src.arr(), value.cvScalar(), dst.arr(), mask.arr())
+		} else {
+			C.try_cvXorS(src.arr(), value.cvScalar(), dst.arr(), nil)
+		}
+		return nil
+	})
+}
+
+// Add adds src1 and src2 element-wise and stores into dst.  Integer results
+// saturate instead of wrapping.  If mask is not nil, only elements with a
+// non-zero mask element are changed.
+func Add(src1, src2, dst, mask Arr) error {
+	mustMatch("Add", "src1", "src2", src1, src2)
+	mustMatch("Add", "src1", "dst", src1, dst)
+	mustMask("Add", mask, "src1", src1)
+	return doErr(func() error {
+		if mask != nil {
+			C.try_cvAdd(src1.arr(), src2.arr(), dst.arr(), mask.arr())
+		} else {
+			C.try_cvAdd(src1.arr(), src2.arr(), dst.arr(), nil)
+		}
+		return nil
+	})
+}
+
+// AddS adds value to each element of src and stores into dst.  Integer
+// results saturate.  If mask is not nil, only elements with a non-zero mask
+// element are changed.
+func AddS(src Arr, value Scalar, dst, mask Arr) error {
+	mustMatch("AddS", "src", "dst", src, dst)
+	mustMask("AddS", mask, "src", src)
+	return doErr(func() error {
+		if mask != nil {
+			C.try_cvAddS(src.arr(), value.cvScalar(), dst.arr(), mask.arr())
+		} else {
+			C.try_cvAddS(src.arr(), value.cvScalar(), dst.arr(), nil)
+		}
+		return nil
+	})
+}
+
+// AddWeighted stores src1*alpha + src2*beta + gamma into dst, which is useful
+// for blending two images.  Integer results saturate.
+func AddWeighted(src1 Arr, alpha float64, src2 Arr, beta, gamma float64, dst Arr) error {
+	mustMatch("AddWeighted", "src1", "src2", src1, src2)
+	mustMatch("AddWeighted", "src1", "dst", src1, dst)
+	return doErr(func() error {
+		C.try_cvAddWeighted(src1.arr(), C.double(alpha), src2.arr(), C.double(beta), C.double(gamma), dst.arr())
+		return nil
+	})
+}
+
+// Sub subtracts src2 from src1 element-wise and stores into dst.  Integer
+// results saturate, so negative differences of unsigned images become zero.
+// If mask is not nil, only elements with a non-zero mask element are changed.
+func Sub(src1, src2, dst, mask Arr) error {
+	mustMatch("Sub", "src1", "src2", src1, src2)
+	mustMatch("Sub", "src1", "dst", src1, dst)
+	mustMask("Sub", mask, "src1", src1)
+	return doErr(func() error {
+		if mask != nil {
+			C.try_cvSub(src1.arr(), src2.arr(), dst.arr(), mask.arr())
+		} else {
+			C.try_cvSub(src1.arr(), src2.arr(), dst.arr(), nil)
+		}
+		return nil
+	})
+}
+
+// SubS subtracts value from each element of src and stores into dst.  Integer
+// results saturate.  If mask is not nil, only elements with a non-zero mask
+// element are changed.
+func SubS(src Arr, value Scalar, dst, mask Arr) error {
+	mustMatch("SubS", "src", "dst", src, dst)
+	mustMask("SubS", mask, "src", src)
+	return doErr(func() error {
+		if mask != nil {
+			C.try_cvSubS(src.arr(), value.cvScalar(), dst.arr(), mask.arr())
+		} else {
+			C.try_cvSubS(src.arr(), value.cvScalar(), dst.arr(), nil)
+		}
+		return nil
+	})
+}
+
+// SubRS subtracts each element of src from value and stores into dst.
+// Integer results saturate.  If mask is not nil, only elements with a non-zero
+// mask element are changed.
+func SubRS(src Arr, value Scalar, dst, mask Arr) error {
+	mustMatch("SubRS", "src", "dst", src, dst)
+	mustMask("SubRS", mask, "src", src)
+	return doErr(func() error {
 		if mask != nil {
-			C.cvOr(src1.arr(), src2.arr(), dst.arr(), mask.arr())
+			C.try_cvSubRS(src.arr(), value.cvScalar(), dst.arr(), mask.arr())
 		} else {
-			C.cvOr(src1.arr(), src2.arr(), dst.arr(), nil)
+			C.try_cvSubRS(src.arr(), value.cvScalar(), dst.arr(), nil)
 		}
+		return nil
+	})
+}
+
+// Mul stores src1*src2*scale into dst element-wise.  Integer results are
+// rounded and saturate.
+func Mul(src1, src2, dst Arr, scale float64) error {
+	mustMatch("Mul", "src1", "src2", src1, src2)
+	mustMatch("Mul", "src1", "dst", src1, dst)
+	return doErr(func() error {
+		C.try_cvMul(src1.arr(), src2.arr(), dst.arr(), C.double(scale))
+		return nil
+	})
+}
+
+// Div stores src1*scale/src2 into dst element-wise.  If src1 is nil, it stores
+// scale/src2 instead.  Division by zero gives zero.
+func Div(src1, src2, dst Arr, scale float64) error {
+	mustMatch("Div", "src2", "dst", src2, dst)
+	if src1 != nil {
+		mustMatch("Div", "src2", "src1", src2, src1)
+	}
+	return doErr(func() error {
+		if src1 != nil {
+			C.try_cvDiv(src1.arr(), src2.arr(), dst.arr(), C.double(scale))
+		} else {
+			C.try_cvDiv(nil, src2.arr(), dst.arr(), C.double(scale))
+		}
+		return nil
+	})
+}
+
+// AbsDiff stores the absolute difference between src1 and src2 into dst
+// element-wise.  This is the usual way to compare video frames.
+func AbsDiff(src1, src2, dst Arr) error {
+	mustMatch("AbsDiff", "src1", "src2", src1, src2)
+	mustMatch("AbsDiff", "src1", "dst", src1, dst)
+	return doErr(func() error {
+		C.try_cvAbsDiff(src1.arr(), src2.arr(), dst.arr())
+		return nil
+	})
+}
+
+// AbsDiffS stores the absolute difference between each element of src and
+// value into dst.  The arguments are in the same order as AddS and SubS, not
+// the order of cvAbsDiffS.
+func AbsDiffS(src Arr, value Scalar, dst Arr) error {
+	mustMatch("AbsDiffS", "src", "dst", src, dst)
+	return doErr(func() error {
+		C.try_cvAbsDiffS(src.arr(), dst.arr(), value.cvScalar())
+		return nil
+	})
+}
+
+// CmpOp is a comparison operator for Cmp and CmpS.
+type CmpOp int
+
+// Comparison operators
+const (
+	CMP_EQ CmpOp = C.CV_CMP_EQ
+	CMP_GT CmpOp = C.CV_CMP_GT
+	CMP_GE CmpOp = C.CV_CMP_GE
+	CMP_LT CmpOp = C.CV_CMP_LT
+	CMP_LE CmpOp = C.CV_CMP_LE
+	CMP_NE CmpOp = C.CV_CMP_NE
+)
+
+// Cmp compares src1 and src2 element-wise with op.  dst must be an 8-bit
+// single-channel array; each element is set to 255 where the comparison holds
+// and 0 elsewhere, so it can be used as a mask.
+func Cmp(src1, src2, dst Arr, op CmpOp) error {
+	mustMatch("Cmp", "src1", "src2", src1, src2)
+	mustChannels("Cmp", "src1", src1, 1)
+	mustArr("Cmp", "dst", dst)
+	mustType("Cmp", "dst", dst, CV_8UC1)
+	mustSameSize("Cmp", "src1", "dst", src1, dst)
+	return doErr(func() error {
+		C.try_cvCmp(src1.arr(), src2.arr(), dst.arr(), C.int(op))
+		return nil
+	})
+}
+
+// CmpS is like Cmp, but compares each element of src to value.
+func CmpS(src Arr, value float64, dst Arr, op CmpOp) error {
+	mustArr("CmpS", "src", src)
+	mustChannels("CmpS", "src", src, 1)
+	mustArr("CmpS", "dst", dst)
+	mustType("CmpS", "dst", dst, CV_8UC1)
+	mustSameSize("CmpS", "src", "dst", src, dst)
+	return doErr(func() error {
+		C.try_cvCmpS(src.arr(), C.double(value), dst.arr(), C.int(op))
+		return nil
+	})
+}
+
+// InRange checks whether each element of src lies between the corresponding
+// elements of lower and upper, inclusive.  dst must be an 8-bit single-channel
+// array; each element is set to 255 where every channel is in range and 0
+// elsewhere.
+func InRange(src, lower, upper, dst Arr) error {
+	mustMatch("InRange", "src", "lower", src, lower)
+	mustMatch("InRange", "src", "upper", src, upper)
+	mustArr("InRange", "dst", dst)
+	mustType("InRange", "dst", dst, CV_8UC1)
+	mustSameSize("InRange", "src", "dst", src, dst)
+	return doErr(func() error {
+		C.try_cvInRange(src.arr(), lower.arr(), upper.arr(), dst.arr())
+		return nil
+	})
+}
+
+// InRangeS is like InRange, but uses the same bounds for every element.  Every
+// channel is tested, so a channel that shouldn't be constrained needs bounds
+// covering its full range.  For example, after converting an 8-bit image with
+// CvtColor and BGR2HSV, the hues from 20 to 30 are selected by a lower bound of
+// Scalar{20, 0, 0} and an upper bound of Scalar{30, 255, 255}.
+func InRangeS(src Arr, lower, upper Scalar, dst Arr) error {
+	mustArr("InRangeS", "src", src)
+	mustArr("InRangeS", "dst", dst)
+	mustType("InRangeS", "dst", dst, CV_8UC1)
+	mustSameSize("InRangeS", "src", "dst", src, dst)
+	return doErr(func() error {
+		C.try_cvInRangeS(src.arr(), lower.cvScalar(), upper.cvScalar(), dst.arr())
+		return nil
 	})
 }
 
@@ -104,13 +426,18 @@ const (
 	THRESH_OTSU       = C.CV_THRESH_OTSU
 )
 
-// Threshold applies a fixed-level threshold to a grayscale image.
-func Threshold(src, dst Arr, thresh, maxVal float64, thresholdType int) float64 {
+// Threshold applies a fixed-level threshold to each element of src, which must
+// have 8-bit or 32-bit floating-point depth.  dst must have the same size and
+// type as src.
+func Threshold(src, dst Arr, thresh, maxVal float64, thresholdType int) (float64, error) {
+	mustMatch("Threshold", "src", "dst", src, dst)
+	mustDepth("Threshold", "src", src, C.CV_8U, C.CV_32F)
 	var result float64
-	do(func() {
-		result = float64(C.cvThreshold(src.arr(), dst.arr(), C.double(thresh), C.double(maxVal), C.int(thresholdType)))
+	err := doErr(func() error {
+		result = float64(C.try_cvThreshold(src.arr(), dst.arr(), C.double(thresh), C.double(maxVal), C.int(thresholdType)))
+		return nil
 	})
-	return result
+	return result, err
 }
 
 // Color space conversions
@@ -158,9 +485,14 @@ const (
 )
 
 // CvtColor converts an image from one color space to another.
-func CvtColor(src, dst Arr, code int) {
-	do(func() {
-		C.cvCvtColor(src.arr(), dst.arr(), C.int(code))
+func CvtColor(src, dst Arr, code int) error {
+	mustArr("CvtColor", "src", src)
+	mustArr("CvtColor", "dst", dst)
+	mustSameSize("CvtColor", "src", "dst", src, dst)
+	mustSameDepth("CvtColor", "src", "dst", src, dst)
+	return doErr(func() error {
+		C.try_cvCvtColor(src.arr(), dst.arr(), C.int(code))
+		return nil
 	})
 }
 
@@ -171,22 +503,39 @@ func CvtColor(src, dst Arr, code int) {
 // destination channel of the first N is not nil, this particular channel is
 // extracted; otherwise an error is raised. The rest of the destination channels
 // (beyond the first N) must always be nil.
-func Split(src, dst0, dst1, dst2, dst3 Arr) {
-	var p0, p1, p2, p3 unsafe.Pointer
-	if dst0 != nil {
-		p0 = dst0.arr()
-	}
-	if dst1 != nil {
-		p1 = dst1.arr()
-	}
-	if dst2 != nil {
-		p2 = dst2.arr()
-	}
-	if dst3 != nil {
-		p3 = dst3.arr()
+func Split(src, dst0, dst1, dst2, dst3 Arr) error {
+	mustArr("Split", "src", src)
+	for i, dst := range []Arr{dst0, dst1, dst2, dst3} {
+		if dst == nil {
+			continue
+		}
+		name := fmt.Sprintf("dst%d", i)
+		mustArr("Split", name, dst)
+		mustChannels("Split", name, dst, 1)
+		mustSameSize("Split", "src", name, src, dst)
+		mustSameDepth("Split", "src", name, src, dst)
+		if t, ok := arrType(src); ok && i >= t.Channels() {
+			panic(fmt.Sprintf("cv: Split: %s given for %d-channel src", name, t.Channels()))
+		}
 	}
-	do(func() {
-		C.cvSplit(src.arr(), p0, p1, p2, p3)
+	return doErr(func() error {
+		// Convert inside the closure so that the destinations stay reachable
+		// until cvSplit returns.
+		var p0, p1, p2, p3 unsafe.Pointer
+		if dst0 != nil {
+			p0 = dst0.arr()
+		}
+		if dst1 != nil {
+			p1 = dst1.arr()
+		}
+		if dst2 != nil {
+			p2 = dst2.arr()
+		}
+		if dst3 != nil {
+			p3 = dst3.arr()
+		}
+		C.try_cvSplit(src.arr(), p0, p1, p2, p3)
+		return nil
 	})
 }
 
@@ -196,16 +545,26 @@ const (
 )
 
 // PyrDown smooths and down-samples the input image.
-func PyrDown(src, dst Arr, filter int) {
-	do(func() {
-		C.cvPyrDown(src.arr(), dst.arr(), C.int(filter))
+func PyrDown(src, dst Arr, filter int) error {
+	mustArr("PyrDown", "src", src)
+	mustArr("PyrDown", "dst", dst)
+	mustSameType("PyrDown", "src", "dst", src, dst)
+	mustHalfSize("PyrDown", src, dst)
+	return doErr(func() error {
+		C.try_cvPyrDown(src.arr(), dst.arr(), C.int(filter))
+		return nil
 	})
 }
 
 // PyrUp up-samples the input image and smooths the result.
-func PyrUp(src, dst Arr, filter int) {
-	do(func() {
-		C.cvPyrDown(src.arr(), dst.arr(), C.int(filter))
+func PyrUp(src, dst Arr, filter int) error {
+	mustArr("PyrUp", "src", src)
+	mustArr("PyrUp", "dst", dst)
+	mustSameType("PyrUp", "src", "dst", src, dst)
+	mustDoubleSize("PyrUp", src, dst)
+	return doErr(func() error {
+		C.try_cvPyrUp(src.arr(), dst.arr(), C.int(filter))
+		return nil
 	})
 }
 
@@ -243,22 +602,35 @@ const (
 
 // Dilate applies a maximum filter to the input image one or more times.  If
 // element is nil, a 3x3 rectangular element is used.
-func Dilate(src, dst Arr, element *IplConvKernel, iterations int) {
-	do(func() {
-		C.cvDilate(src.arr(), dst.arr(), (*C.IplConvKernel)(unsafe.Pointer(element)), C.int(iterations))
+func Dilate(src, dst Arr, element *IplConvKernel, iterations int) error {
+	mustMatch("Dilate", "src", "dst", src, dst)
+	return doErr(func() error {
+		C.try_cvDilate(src.arr(), dst.arr(), (*C.IplConvKernel)(unsafe.Pointer(element)), C.int(iterations))
+		return nil
 	})
 }
 
 // Erode applies a minimum filter to the input image one or more times.  If
 // element is nil, a 3x3 rectangular element is used.
-func Erode(src, dst Arr, element *IplConvKernel, iterations int) {
-	do(func() {
-		C.cvErode(src.arr(), dst.arr(), (*C.IplConvKernel)(unsafe.Pointer(element)), C.int(iterations))
+func Erode(src, dst Arr, element *IplConvKernel, iterations int) error {
+	mustMatch("Erode", "src", "dst", src, dst)
+	return doErr(func() error {
+		C.try_cvErode(src.arr(), dst.arr(), (*C.IplConvKernel)(unsafe.Pointer(element)), C.int(iterations))
+		return nil
 	})
 }
 
-func MorphologyEx(src, dst, temp Arr, element *IplConvKernel, operation Morphology, iterations int) {
-	do(func() {
-		C.cvMorphologyEx(src.arr(), dst.arr(), temp.arr(), (*C.IplConvKernel)(unsafe.Pointer(element)), C.int(operation), C.int(iterations))
+func MorphologyEx(src, dst, temp Arr, element *IplConvKernel, operation Morphology, iterations int) error {
+	mustMatch("MorphologyEx", "src", "dst", src, dst)
+	if temp != nil {
+		mustMatch("MorphologyEx", "src", "temp", src, temp)
+	}
+	return doErr(func() error {
+		if temp != nil {
+			C.try_cvMorphologyEx(src.arr(), dst.arr(), temp.arr(), (*C.IplConvKernel)(unsafe.Pointer(element)), C.int(operation), C.int(iterations))
+		} else {
+			C.try_cvMorphologyEx(src.arr(), dst.arr(), nil, (*C.IplConvKernel)(unsafe.Pointer(element)), C.int(operation), C.int(iterations))
+		}
+		return nil
 	})
 }
@@ -0,0 +1,294 @@
+package cv_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+
+	"bitbucket.org/zombiezen/gocv/cv"
+)
+
+// newRow creates a one-row 8-bit image holding data, which is in interleaved
+// channel order.
+func newRow(tb testing.TB, channels int, data []byte) *cv.IplImage {
+	tb.Helper()
+	img := newImage(tb, len(data)/channels, 1, cv.IPL_DEPTH_8U, channels)
+	copy(img.Row(0), data)
+	return img
+}
+
+// rowBytes returns a copy of the first row of img.
+func rowBytes(img *cv.IplImage) []byte {
+	return append([]byte(nil), img.Row(0)...)
+}
+
+func TestArithmeticSaturation(t *testing.T) {
+	src1 := []byte{0, 10, 200, 255}
+	src2 := []byte{5, 20, 100, 255}
+	tests := []struct {
+		name   string
+		op     func(src1, src2, dst, mask cv.Arr) error
+		want   []byte
+		noMask bool
+	}{
+		{
+			name: "Add",
+			op:   cv.Add,
+			want: []byte{5, 30, 255, 255},
+		},
+		{
+			name: "Sub",
+			op:   cv.Sub,
+			want: []byte{0, 0, 100, 0},
+		},
+		{
+			name: "AddS",
+			op: func(src1, src2, dst, mask cv.Arr) error {
+				return cv.AddS(src1, cv.Scalar{100}, dst, mask)
+			},
+			want: []byte{100, 110, 255, 255},
+		},
+		{
+			name: "SubRS",
+			op: func(src1, src2, dst, mask cv.Arr) error {
+				return cv.SubRS(src1, cv.Scalar{100}, dst, mask)
+			},
+			want: []byte{100, 90, 0, 0},
+		},
+		{
+			name: "Mul",
+			op: func(src1, src2, dst, mask cv.Arr) error {
+				return cv.Mul(src1, src2, dst, 1)
+			},
+			want:   []byte{0, 200, 255, 255},
+			noMask: true,
+		},
+		{
+			name: "Div",
+			op: func(src1, src2, dst, mask cv.Arr) error {
+				return cv.Div(src1, src2, dst, 300)
+			},
+			// 300*src1/src2 is 0, 150, 600 and 300.
+			want:   []byte{0, 150, 255, 255},
+			noMask: true,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			dst := newRow(t, 1, make([]byte, len(src1)))
+			if err := test.op(newRow(t, 1, src1), newRow(t, 1, src2), dst, nil); err != nil {
+				t.Fatal(err)
+			}
+			if got := rowBytes(dst); !bytes.Equal(got, test.want) {
+				t.Errorf("got %v; want %v", got, test.want)
+			}
+		})
+		if test.noMask {
+			continue
+		}
+		t.Run(test.name+"/mask", func(t *testing.T) {
+			const old = 7
+			dst := newRow(t, 1, bytes.Repeat([]byte{old}, len(src1)))
+			mask := newRow(t, 1, []byte{255, 0, 1, 0})
+			if err := test.op(newRow(t, 1, src1), newRow(t, 1, src2), dst, mask); err != nil {
+				t.Fatal(err)
+			}
+			want := []byte{test.want[0], old, test.want[2], old}
+			if got := rowBytes(dst); !bytes.Equal(got, want) {
+				t.Errorf("got %v; want %v", got, want)
+			}
+		})
+	}
+}
+
+func TestAbsDiff(t *testing.T) {
+	src1 := newRow(t, 1, []byte{0, 10, 200, 255})
+	src2 := newRow(t, 1, []byte{5, 20, 100, 255})
+	dst := newRow(t, 1, make([]byte, 4))
+	if err := cv.AbsDiff(src1, src2, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rowBytes(dst), []byte{5, 10, 100, 0}; !bytes.Equal(got, want) {
+		t.Errorf("AbsDiff = %v; want %v", got, want)
+	}
+	if err := cv.AbsDiffS(src1, cv.Scalar{100}, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rowBytes(dst), []byte{100, 90, 100, 155}; !bytes.Equal(got, want) {
+		t.Errorf("AbsDiffS = %v; want %v", got, want)
+	}
+}
+
+func TestAddWeighted(t *testing.T) {
+	src1 := newRow(t, 1, []byte{0, 10, 200, 255})
+	src2 := newRow(t, 1, []byte{5, 20, 100, 255})
+	dst := newRow(t, 1, make([]byte, 4))
+	// 2*src1 + src2 - 10 goes below 0 in the first element and above 255 in
+	// the last two.
+	if err := cv.AddWeighted(src1, 2, src2, 1, -10, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rowBytes(dst), []byte{0, 30, 255, 255}; !bytes.Equal(got, want) {
+		t.Errorf("got %v; want %v", got, want)
+	}
+}
+
+func TestBitwise(t *testing.T) {
+	value := cv.Scalar{0x0f, 0xaa, 0x55, 0}
+	tests := []struct {
+		name string
+		op   func(src1, src2, dst, mask cv.Arr) error
+		// f computes one element from the sources and the value's element for
+		// its channel.
+		f      func(a, b, v byte) byte
+		noMask bool
+	}{
+		{
+			name: "Xor",
+			op:   cv.Xor,
+			f:    func(a, b, v byte) byte { return a ^ b },
+		},
+		{
+			name: "Not",
+			op: func(src1, src2, dst, mask cv.Arr) error {
+				return cv.Not(src1, dst)
+			},
+			f:      func(a, b, v byte) byte { return ^a },
+			noMask: true,
+		},
+		{
+			name: "AndS",
+			op: func(src1, src2, dst, mask cv.Arr) error {
+				return cv.AndS(src1, value, dst, mask)
+			},
+			f: func(a, b, v byte) byte { return a & v },
+		},
+		{
+			name: "OrS",
+			op: func(src1, src2, dst, mask cv.Arr) error {
+				return cv.OrS(src1, value, dst, mask)
+			},
+			f: func(a, b, v byte) byte { return a | v },
+		},
+		{
+			name: "XorS",
+			op: func(src1, src2, dst, mask cv.Arr) error {
+				return cv.XorS(src1, value, dst, mask)
+			},
+			f: func(a, b, v byte) byte { return a ^ v },
+		},
+	}
+	const width = 4
+	maskData := []byte{255, 0, 1, 0}
+	for _, channels := range []int{1, 3} {
+		src1Data := make([]byte, width*channels)
+		src2Data := make([]byte, width*channels)
+		for i := range src1Data {
+			src1Data[i] = byte(0xf0 ^ i*17)
+			src2Data[i] = byte(0x3c + i*29)
+		}
+		for _, test := range tests {
+			want := make([]byte, len(src1Data))
+			for i := range want {
+				want[i] = test.f(src1Data[i], src2Data[i], byte(value[i%channels]))
+			}
+			name := fmt.Sprintf("%s/%dchannel", test.name, channels)
+			t.Run(name, func(t *testing.T) {
+				dst := newRow(t, channels, make([]byte, len(want)))
+				if err := test.op(newRow(t, channels, src1Data), newRow(t, channels, src2Data), dst, nil); err != nil {
+					t.Fatal(err)
+				}
+				if got := rowBytes(dst); !bytes.Equal(got, want) {
+					t.Errorf("got %v; want %v", got, want)
+				}
+			})
+			if test.noMask {
+				continue
+			}
+			t.Run(name+"/mask", func(t *testing.T) {
+				const old = 7
+				dst := newRow(t, channels, bytes.Repeat([]byte{old}, len(want)))
+				mask := newRow(t, 1, maskData)
+				if err := test.op(newRow(t, channels, src1Data), newRow(t, channels, src2Data), dst, mask); err != nil {
+					t.Fatal(err)
+				}
+				masked := append([]byte(nil), want...)
+				for i := range masked {
+					if maskData[i/channels] == 0 {
+						masked[i] = old
+					}
+				}
+				if got := rowBytes(dst); !bytes.Equal(got, masked) {
+					t.Errorf("got %v; want %v", got, masked)
+				}
+			})
+		}
+	}
+}
+
+func TestCmp(t *testing.T) {
+	src1 := newRow(t, 1, []byte{0, 10, 200, 255})
+	src2 := newRow(t, 1, []byte{5, 10, 100, 255})
+	dst := newRow(t, 1, make([]byte, 4))
+	if err := cv.Cmp(src1, src2, dst, cv.CMP_GT); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rowBytes(dst), []byte{0, 0, 255, 0}; !bytes.Equal(got, want) {
+		t.Errorf("Cmp = %v; want %v", got, want)
+	}
+	if err := cv.CmpS(src1, 10, dst, cv.CMP_LE); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rowBytes(dst), []byte{255, 255, 0, 0}; !bytes.Equal(got, want) {
+		t.Errorf("CmpS = %v; want %v", got, want)
+	}
+}
+
+func TestInRange(t *testing.T) {
+	src := newRow(t, 1, []byte{4, 5, 6, 7})
+	lower := newRow(t, 1, []byte{5, 5, 5, 5})
+	upper := newRow(t, 1, []byte{6, 6, 6, 6})
+	dst := newRow(t, 1, make([]byte, 4))
+	if err := cv.InRange(src, lower, upper, dst); err != nil {
+		t.Fatal(err)
+	}
+	// Both bounds are inclusive.
+	if got, want := rowBytes(dst), []byte{0, 255, 255, 0}; !bytes.Equal(got, want) {
+		t.Errorf("InRange = %v; want %v", got, want)
+	}
+
+	hsv := newRow(t, 3, []byte{
+		20, 100, 100,
+		30, 0, 255,
+		31, 100, 100,
+		19, 255, 255,
+	})
+	if err := cv.InRangeS(hsv, cv.Scalar{20, 0, 0}, cv.Scalar{30, 255, 255}, dst); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rowBytes(dst), []byte{255, 255, 0, 0}; !bytes.Equal(got, want) {
+		t.Errorf("InRangeS = %v; want %v", got, want)
+	}
+}
+
+func TestPyrUp(t *testing.T) {
+	src := newImage(t, 4, 4, cv.IPL_DEPTH_8U, 1)
+	for y := 0; y < 4; y++ {
+		row := src.Row(y)
+		for x := range row[:4] {
+			row[x] = 100
+		}
+	}
+	dst := newImage(t, 8, 8, cv.IPL_DEPTH_8U, 1)
+	if err := cv.PyrUp(src, dst, cv.GAUSSIAN_5x5); err != nil {
+		t.Fatal("PyrUp:", err)
+	}
+	// Smoothing a constant image leaves it unchanged.
+	for y := 0; y < 8; y++ {
+		for x, v := range dst.Row(y)[:8] {
+			if v != 100 {
+				t.Fatalf("pixel (%d, %d) = %d; want 100", x, y, v)
+			}
+		}
+	}
+}
@@ -0,0 +1,93 @@
+package cv
+
+// #include "shim.h"
+import "C"
+
+import (
+	"context"
+	"fmt"
+	"runtime"
+)
+
+func init() {
+	C.installErrorHandler()
+}
+
+// Error is an error reported by OpenCV.
+type Error struct {
+	// Status is the OpenCV status code, like CV_StsBadArg.
+	Status int
+	// Func is the name of the OpenCV function that failed.
+	Func string
+	// File and Line give the location in the OpenCV source of the failure.
+	File string
+	Line int
+	// Message describes the failure.
+	Message string
+}
+
+func (e *Error) Error() string {
+	msg := C.GoString(C.cvErrorStr(C.int(e.Status)))
+	if e.Message != "" {
+		msg = fmt.Sprintf("%s (%s)", e.Message, msg)
+	}
+	if e.Func == "" {
+		return "cv: " + msg
+	}
+	return fmt.Sprintf("cv: %s: %s", e.Func, msg)
+}
+
+// doErr is like do, but f may return an error.  OpenCV calls made by f must
+// go through the try_ functions in shim.h.  If f returns nil, the first error
+// that OpenCV reported while f was running is returned instead.
+func doErr(f func() error) error {
+	var err error
+	do(func() {
+		err = catchErr(f)
+	})
+	return err
+}
+
+// doErrContext is like doErr, but stops waiting if ctx is done first.
+func doErrContext(ctx context.Context, f func() error) error {
+	var err error
+	if cerr := doContext(ctx, func() {
+		err = catchErr(f)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// catchErr calls f and returns its error, or else the first error that OpenCV
+// reported while it was running.
+func catchErr(f func() error) error {
+	// The error state belongs to the OS thread, so f must not move to another
+	// thread between clearing and reading it.  This only matters when calls
+	// run directly on the calling goroutine.
+	runtime.LockOSThread()
+	defer runtime.UnlockOSThread()
+	C.clearError()
+	err := f()
+	if e := takeError(); e != nil && err == nil {
+		return e
+	}
+	return err
+}
+
+// takeError returns the error recorded on the current thread, if any, and
+// clears it.  It must be called on a thread that makes OpenCV calls.
+func takeError() *Error {
+	if C.getErrStatus() == 0 {
+		return nil
+	}
+	e := &Error{
+		Status:  int(C.getErrStatus()),
+		Func:    C.GoString(C.getErrFunc()),
+		File:    C.GoString(C.getErrFile()),
+		Line:    int(C.getErrLine()),
+		Message: C.GoString(C.getErrMsg()),
+	}
+	C.clearError()
+	return e
+}
@@ -0,0 +1,5 @@
+package cv
+
+// Do makes a call through the dispatcher like the wrappers do, so that tests
+// can keep a thread busy.
+var Do = do
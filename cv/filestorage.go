@@ -0,0 +1,428 @@
+package cv
+
+// #include "shim.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// File storage modes
+const (
+	STORAGE_READ   = C.CV_STORAGE_READ
+	STORAGE_WRITE  = C.CV_STORAGE_WRITE
+	STORAGE_APPEND = C.CV_STORAGE_APPEND
+)
+
+// File node types
+const (
+	NODE_NONE = C.CV_NODE_NONE
+	NODE_INT  = C.CV_NODE_INT
+	NODE_REAL = C.CV_NODE_REAL
+	NODE_STR  = C.CV_NODE_STR
+	NODE_SEQ  = C.CV_NODE_SEQ
+	NODE_MAP  = C.CV_NODE_MAP
+
+	// NODE_FLOW can be combined with NODE_SEQ or NODE_MAP in StartWriteStruct to
+	// write the structure on a single line.
+	NODE_FLOW = C.CV_NODE_FLOW
+)
+
+// FileStorage is an XML or YAML file that holds OpenCV data structures.  The
+// format is chosen by the file's extension and is compatible with the C++
+// FileStorage class.  A FileStorage is closed automatically when it is
+// garbage collected, but Close must be called to make sure a written file is
+// complete.
+type FileStorage struct {
+	// mu is held while the file is being closed.
+	mu sync.Mutex
+	fs *C.CvFileStorage
+	// storage holds sequences read from the file.
+	storage *MemStorage
+}
+
+// OpenFileStorage opens the file called name.  flags is one of STORAGE_READ,
+// STORAGE_WRITE or STORAGE_APPEND.
+func OpenFileStorage(name string, flags int) (*FileStorage, error) {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	storage := NewMemStorage(0)
+	var fs *C.CvFileStorage
+	err := doErr(func() error {
+		fs = C.try_cvOpenFileStorage(cname, storage.s, C.int(flags), nil)
+		return nil
+	})
+	if err != nil {
+		storage.Release()
+		return nil, err
+	}
+	if fs == nil {
+		storage.Release()
+		return nil, fmt.Errorf("cv: OpenFileStorage %s: cannot open file", name)
+	}
+	f := &FileStorage{fs: fs, storage: storage}
+	runtime.SetFinalizer(f, (*FileStorage).finalize)
+	return f, nil
+}
+
+// Close flushes any written data and closes the file.  Nodes and sequences read
+// from the file must not be used afterward, but calling Close or Release again
+// is a no-op.
+func (f *FileStorage) Close() error {
+	runtime.SetFinalizer(f, nil)
+	err := doErr(f.close)
+	f.storage.Release()
+	return err
+}
+
+// Release is like Close, but ignores errors from flushing the file.
+func (f *FileStorage) Release() {
+	f.Close()
+}
+
+func (f *FileStorage) close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.fs != nil {
+		C.try_cvReleaseFileStorage(&f.fs)
+	}
+	return nil
+}
+
+func (f *FileStorage) finalize() {
+	releaseLater(func() {
+		catchErr(f.close)
+	})
+}
+
+// WriteInt writes an integer.  name must be empty inside of a sequence and
+// non-empty everywhere else.
+func (f *FileStorage) WriteInt(name string, value int) error {
+	cname := nodeName(name)
+	defer C.free(unsafe.Pointer(cname))
+	return doErr(func() error {
+		C.try_cvWriteInt(f.fs, cname, C.int(value))
+		return nil
+	})
+}
+
+// WriteReal writes a floating-point number.
+func (f *FileStorage) WriteReal(name string, value float64) error {
+	cname := nodeName(name)
+	defer C.free(unsafe.Pointer(cname))
+	return doErr(func() error {
+		C.try_cvWriteReal(f.fs, cname, C.double(value))
+		return nil
+	})
+}
+
+// WriteString writes a text string.
+func (f *FileStorage) WriteString(name string, value string) error {
+	cname := nodeName(name)
+	defer C.free(unsafe.Pointer(cname))
+	cvalue := C.CString(value)
+	defer C.free(unsafe.Pointer(cvalue))
+	return doErr(func() error {
+		C.try_cvWriteString(f.fs, cname, cvalue, 0)
+		return nil
+	})
+}
+
+// WriteComment writes a comment.  If eolComment is true, the comment is put at
+// the end of the current line if possible.
+func (f *FileStorage) WriteComment(comment string, eolComment bool) error {
+	ccomment := C.CString(comment)
+	defer C.free(unsafe.Pointer(ccomment))
+	var ceol C.int
+	if eolComment {
+		ceol = 1
+	}
+	return doErr(func() error {
+		C.try_cvWriteComment(f.fs, ccomment, ceol)
+		return nil
+	})
+}
+
+// StartWriteStruct starts writing a sequence or map.  flags is NODE_SEQ or
+// NODE_MAP, optionally combined with NODE_FLOW.  Every call must be matched by
+// a call to EndWriteStruct.
+func (f *FileStorage) StartWriteStruct(name string, flags int) error {
+	cname := nodeName(name)
+	defer C.free(unsafe.Pointer(cname))
+	return doErr(func() error {
+		C.try_cvStartWriteStruct(f.fs, cname, C.int(flags), nil, C.CvAttrList{})
+		return nil
+	})
+}
+
+// EndWriteStruct finishes the sequence or map started by StartWriteStruct.
+func (f *FileStorage) EndWriteStruct() error {
+	return doErr(func() error {
+		C.try_cvEndWriteStruct(f.fs)
+		return nil
+	})
+}
+
+// Write writes an OpenCV object: an *IplImage, *Mat, *MatND, *SparseMat or Seq.
+func (f *FileStorage) Write(name string, obj Arr) error {
+	if isNilArr(obj) {
+		return errors.New("cv: FileStorage.Write: object is nil or released")
+	}
+	cname := nodeName(name)
+	defer C.free(unsafe.Pointer(cname))
+	return doErr(func() error {
+		C.try_cvWrite(f.fs, cname, obj.arr(), C.CvAttrList{})
+		return nil
+	})
+}
+
+// Root returns the top-level map of the file.
+func (f *FileStorage) Root() FileNode {
+	var n *C.CvFileNode
+	do(func() {
+		n = C.cvGetRootFileNode(f.fs, 0)
+	})
+	return FileNode{f, n}
+}
+
+// Get returns the top-level node called name.  The returned node is zero if
+// there is no such node.
+func (f *FileStorage) Get(name string) FileNode {
+	return f.getNode(nil, name)
+}
+
+func (f *FileStorage) getNode(parent *C.CvFileNode, name string) FileNode {
+	cname := C.CString(name)
+	defer C.free(unsafe.Pointer(cname))
+	var n *C.CvFileNode
+	do(func() {
+		n = C.cvGetFileNodeByName(f.fs, parent, cname)
+	})
+	return FileNode{f, n}
+}
+
+// FileNode is a value read from a FileStorage.  It is only valid until the
+// FileStorage is released.
+type FileNode struct {
+	fs *FileStorage
+	n  *C.CvFileNode
+}
+
+// IsZero reports whether the node does not exist.
+func (n FileNode) IsZero() bool {
+	return n.n == nil
+}
+
+// Type returns the node's type, such as NODE_INT or NODE_MAP.
+func (n FileNode) Type() int {
+	if n.n == nil {
+		return NODE_NONE
+	}
+	return int(n.n.tag & C.CV_NODE_TYPE_MASK)
+}
+
+// Int returns the node's value as an integer.  Real numbers are truncated and
+// any other type of node returns zero.
+func (n FileNode) Int() int {
+	var i C.int
+	do(func() {
+		i = C.cvReadInt(n.n, 0)
+	})
+	return int(i)
+}
+
+// Real returns the node's value as a floating-point number.  Any type of node
+// other than an integer or real number returns zero.
+func (n FileNode) Real() float64 {
+	var r C.double
+	do(func() {
+		r = C.cvReadReal(n.n, 0)
+	})
+	return float64(r)
+}
+
+// String returns the node's value as a string.  Any type of node other than a
+// string returns the empty string.
+func (n FileNode) String() string {
+	var s string
+	do(func() {
+		if cs := C.cvReadString(n.n, nil); cs != nil {
+			s = C.GoString(cs)
+		}
+	})
+	return s
+}
+
+// Len returns the number of elements in a sequence or map node.
+func (n FileNode) Len() int {
+	switch n.Type() {
+	case NODE_NONE:
+		return 0
+	case NODE_SEQ:
+		return int(n.seq().total)
+	case NODE_MAP:
+		return int((*(**C.CvSet)(n.union())).active_count)
+	default:
+		return 1
+	}
+}
+
+// At returns element i of a sequence node.
+func (n FileNode) At(i int) FileNode {
+	if n.Type() != NODE_SEQ {
+		panic("cv: FileNode.At called on a node that is not a sequence")
+	}
+	seq := n.seq()
+	if i < 0 || i >= int(seq.total) {
+		panic("FileNode index out of bounds")
+	}
+	var elem *C.CvFileNode
+	do(func() {
+		elem = (*C.CvFileNode)(unsafe.Pointer(C.cvGetSeqElem(seq, C.int(i))))
+	})
+	return FileNode{n.fs, elem}
+}
+
+// Get returns the element called name of a map node.  The returned node is
+// zero if there is no such element.
+func (n FileNode) Get(name string) FileNode {
+	return n.fs.getNode(n.n, name)
+}
+
+// Keys returns the names of a map node's elements.
+func (n FileNode) Keys() []string {
+	if n.Type() != NODE_MAP {
+		return nil
+	}
+	set := *(**C.CvSeq)(n.union())
+	var keys []string
+	do(func() {
+		for i := 0; i < int(set.total); i++ {
+			// Map elements start with their value node.
+			elem := (*C.CvFileNode)(unsafe.Pointer(C.cvGetSeqElem(set, C.int(i))))
+			if elem.tag < 0 {
+				// Free set element
+				continue
+			}
+			keys = append(keys, C.GoString(C.cvGetFileNodeName(elem)))
+		}
+	})
+	return keys
+}
+
+// Read decodes an OpenCV object written with Write.  The result is an
+// *IplImage, *Mat, *MatND, *SparseMat or Seq.
+func (n FileNode) Read() (interface{}, error) {
+	var ptr unsafe.Pointer
+	do(func() {
+		ptr = C.cvRead(n.fs.fs, n.n, nil)
+	})
+	if ptr == nil {
+		return nil, errors.New("cv: FileNode.Read: node is not an OpenCV object")
+	}
+	return wrapObject(ptr, n.fs.storage)
+}
+
+func (n FileNode) seq() *C.CvSeq {
+	return *(**C.CvSeq)(n.union())
+}
+
+// union returns the address of the node's data.
+func (n FileNode) union() unsafe.Pointer {
+	return unsafe.Pointer(&n.n.data)
+}
+
+// Save writes obj to an XML or YAML file called filename.  name is the name of
+// the object in the file; if it is empty, a name is chosen from filename.
+// comment may be empty.
+func Save(filename string, obj Arr, name, comment string) error {
+	if isNilArr(obj) {
+		return errors.New("cv: Save: object is nil or released")
+	}
+	cfilename := C.CString(filename)
+	defer C.free(unsafe.Pointer(cfilename))
+	cname := nodeName(name)
+	defer C.free(unsafe.Pointer(cname))
+	ccomment := nodeName(comment)
+	defer C.free(unsafe.Pointer(ccomment))
+	return doErr(func() error {
+		C.try_cvSave(cfilename, obj.arr(), cname, ccomment, C.CvAttrList{})
+		return nil
+	})
+}
+
+// Load reads an object written by Save or Write from the file called filename.
+// If name is empty, the first top-level object is read.  The result is an
+// *IplImage, *Mat, *MatND, *SparseMat or Seq.
+func Load(filename string, name string) (interface{}, error) {
+	cfilename := C.CString(filename)
+	defer C.free(unsafe.Pointer(cfilename))
+	cname := nodeName(name)
+	defer C.free(unsafe.Pointer(cname))
+
+	storage := NewMemStorage(0)
+	var ptr unsafe.Pointer
+	err := doErr(func() error {
+		ptr = C.try_cvLoad(cfilename, storage.s, cname, nil)
+		return nil
+	})
+	if err != nil {
+		storage.Release()
+		return nil, err
+	}
+	if ptr == nil {
+		storage.Release()
+		return nil, fmt.Errorf("cv: Load %s: cannot read object", filename)
+	}
+	obj, err := wrapObject(ptr, storage)
+	if err != nil {
+		storage.Release()
+		return nil, err
+	}
+	return obj, nil
+}
+
+// wrapObject returns a Go value for an object returned by cvRead or cvLoad.
+// Sequences are allocated in storage.
+func wrapObject(ptr unsafe.Pointer, storage *MemStorage) (interface{}, error) {
+	var typeName string
+	do(func() {
+		if info := C.cvTypeOf(ptr); info != nil {
+			typeName = C.GoString(info.type_name)
+		}
+	})
+	switch typeName {
+	case "opencv-image":
+		return newIplImage((*C.IplImage)(ptr)), nil
+	case "opencv-matrix":
+		return newMat((*C.CvMat)(ptr), nil), nil
+	case "opencv-nd-matrix":
+		m := &MatND{m: (*C.CvMatND)(ptr)}
+		runtime.SetFinalizer(m, (*MatND).finalize)
+		return m, nil
+	case "opencv-sparse-matrix":
+		m := &SparseMat{m: (*C.CvSparseMat)(ptr)}
+		runtime.SetFinalizer(m, (*SparseMat).finalize)
+		return m, nil
+	case "opencv-sequence", "opencv-sequence-tree":
+		return Seq{(*C.CvSeq)(ptr), storage}, nil
+	}
+	do(func() {
+		C.cvRelease(&ptr)
+	})
+	return nil, fmt.Errorf("cv: unsupported object type %q", typeName)
+}
+
+// nodeName converts name to a C string, or nil if name is empty.  The result
+// must be freed.
+func nodeName(name string) *C.char {
+	if name == "" {
+		return nil
+	}
+	return C.CString(name)
+}
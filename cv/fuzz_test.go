@@ -0,0 +1,212 @@
+package cv_test
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"bitbucket.org/zombiezen/gocv/cv"
+)
+
+// The fuzz targets in this file pass bad arguments to the wrappers: nil and
+// released arrays, zero sequences, and arrays whose sizes, depths or channel
+// counts don't match.  Every call must either return an error or panic with a
+// "cv: " message.  Anything that reaches OpenCV unchecked crashes the test
+// binary instead.
+
+var fuzzDepths = []cv.Depth{
+	cv.IPL_DEPTH_8U,
+	cv.IPL_DEPTH_8S,
+	cv.IPL_DEPTH_16U,
+	cv.IPL_DEPTH_16S,
+	cv.IPL_DEPTH_32S,
+	cv.IPL_DEPTH_32F,
+	cv.IPL_DEPTH_64F,
+}
+
+var fuzzMatTypes = []cv.MatType{
+	cv.CV_8UC1,
+	cv.CV_8UC3,
+	cv.CV_16SC1,
+	cv.CV_32SC2,
+	cv.CV_32FC1,
+	cv.CV_64FC4,
+}
+
+// fuzzArr builds an array described by a fuzz input.  kind picks among a nil
+// interface, a nil pointer, a released image, a zero Seq, a matrix and an
+// image.  w and h are kept small so that every target runs quickly.
+func fuzzArr(t *testing.T, kind, w, h, depth, channels uint8) cv.Arr {
+	t.Helper()
+	size := cv.Size{Width: int(w%16) + 1, Height: int(h%16) + 1}
+	switch kind % 6 {
+	case 0:
+		return nil
+	case 1:
+		return (*cv.IplImage)(nil)
+	case 2:
+		img, err := cv.NewImage(size, cv.IPL_DEPTH_8U, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		img.Release()
+		return img
+	case 3:
+		return cv.Seq{}
+	case 4:
+		m, err := cv.NewMat(size.Height, size.Width, fuzzMatTypes[int(depth)%len(fuzzMatTypes)])
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(m.Release)
+		return m
+	default:
+		img, err := cv.NewImage(size, fuzzDepths[int(depth)%len(fuzzDepths)], int(channels%4)+1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(img.Release)
+		return img
+	}
+}
+
+// checkCall runs f and fails the test if it panics with anything other than a
+// validation message from the package.  Errors from f are expected.
+func checkCall(t *testing.T, name string, f func() error) {
+	t.Helper()
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		if msg := fmt.Sprint(r); !strings.HasPrefix(msg, "cv: ") {
+			t.Errorf("%s panicked: %v", name, r)
+		}
+	}()
+	f()
+}
+
+func FuzzArr(f *testing.F) {
+	f.Add(uint8(5), uint8(5), uint8(3), uint8(4), uint8(0), uint8(3), 1, 2)
+	f.Add(uint8(5), uint8(4), uint8(3), uint8(3), uint8(2), uint8(3), -1, 100)
+	f.Add(uint8(2), uint8(5), uint8(0), uint8(0), uint8(0), uint8(0), 0, 0)
+	f.Fuzz(func(t *testing.T, kind1, kind2, w, h, depth, channels uint8, idx0, idx1 int) {
+		a := fuzzArr(t, kind1, w, h, depth, channels)
+		b := fuzzArr(t, kind2, w, h+uint8(idx0), depth+uint8(idx1), channels)
+		checkCall(t, "Copy", func() error { return cv.Copy(a, b, nil) })
+		checkCall(t, "ConvertScale", func() error { return cv.ConvertScale(a, b, 2, 1) })
+		checkCall(t, "SetData", func() error {
+			return cv.SetData(a, make([]byte, int(w)*int(h)), int(w))
+		})
+		checkCall(t, "Get1D", func() error { _, err := cv.Get1D(a, idx0); return err })
+		checkCall(t, "Get2D", func() error { _, err := cv.Get2D(a, idx0, idx1); return err })
+		checkCall(t, "GetND", func() error { _, err := cv.GetND(a, []int{idx0, idx1}); return err })
+		checkCall(t, "GetReal2D", func() error { _, err := cv.GetReal2D(a, idx0, idx1); return err })
+		checkCall(t, "Set2D", func() error { return cv.Set2D(a, idx0, idx1, cv.Scalar{1, 2, 3, 4}) })
+		checkCall(t, "SetND", func() error { return cv.SetND(a, []int{idx0}, cv.Scalar{1}) })
+		checkCall(t, "SetReal2D", func() error { return cv.SetReal2D(a, idx0, idx1, 1) })
+	})
+}
+
+func FuzzArithmetic(f *testing.F) {
+	f.Add(uint8(5), uint8(5), uint8(5), uint8(0), uint8(8), uint8(8), uint8(0), uint8(0), uint8(1))
+	f.Add(uint8(5), uint8(4), uint8(5), uint8(5), uint8(8), uint8(8), uint8(0), uint8(1), uint8(2))
+	f.Add(uint8(5), uint8(5), uint8(2), uint8(3), uint8(8), uint8(8), uint8(5), uint8(2), uint8(0))
+	f.Fuzz(func(t *testing.T, kind1, kind2, kindDst, kindMask, w, h, depth, channels, shift uint8) {
+		src1 := fuzzArr(t, kind1, w, h, depth, channels)
+		src2 := fuzzArr(t, kind2, w+shift%2, h, depth+shift/2%2, channels)
+		dst := fuzzArr(t, kindDst, w, h+shift/4%2, depth+shift/8%2, channels+shift/16%2)
+		mask := fuzzArr(t, kindMask, w, h, 0, 0)
+		value := cv.Scalar{1, 2, 3, 4}
+		checkCall(t, "Add", func() error { return cv.Add(src1, src2, dst, mask) })
+		checkCall(t, "AddS", func() error { return cv.AddS(src1, value, dst, mask) })
+		checkCall(t, "AddWeighted", func() error { return cv.AddWeighted(src1, 0.5, src2, 0.5, 0, dst) })
+		checkCall(t, "Sub", func() error { return cv.Sub(src1, src2, dst, mask) })
+		checkCall(t, "SubS", func() error { return cv.SubS(src1, value, dst, mask) })
+		checkCall(t, "SubRS", func() error { return cv.SubRS(src1, value, dst, mask) })
+		checkCall(t, "Mul", func() error { return cv.Mul(src1, src2, dst, 1) })
+		checkCall(t, "Div", func() error { return cv.Div(src1, src2, dst, 1) })
+		checkCall(t, "AbsDiff", func() error { return cv.AbsDiff(src1, src2, dst) })
+		checkCall(t, "AbsDiffS", func() error { return cv.AbsDiffS(src1, value, dst) })
+		checkCall(t, "And", func() error { return cv.And(src1, src2, dst, mask) })
+		checkCall(t, "Or", func() error { return cv.Or(src1, src2, dst, mask) })
+		checkCall(t, "Xor", func() error { return cv.Xor(src1, src2, dst, mask) })
+		checkCall(t, "Not", func() error { return cv.Not(src1, dst) })
+		checkCall(t, "AndS", func() error { return cv.AndS(src1, value, dst, mask) })
+		checkCall(t, "OrS", func() error { return cv.OrS(src1, value, dst, mask) })
+		checkCall(t, "XorS", func() error { return cv.XorS(src1, value, dst, mask) })
+		checkCall(t, "Cmp", func() error { return cv.Cmp(src1, src2, dst, cv.CMP_GT) })
+		checkCall(t, "CmpS", func() error { return cv.CmpS(src1, 1, dst, cv.CMP_LE) })
+		checkCall(t, "InRange", func() error { return cv.InRange(src1, src2, src2, dst) })
+		checkCall(t, "InRangeS", func() error { return cv.InRangeS(src1, cv.Scalar{}, value, dst) })
+	})
+}
+
+var fuzzColorCodes = []int{
+	cv.BGR2XYZ,
+	cv.BGR2YCrCb,
+	cv.BGR2HSV,
+	cv.BGR2HLS,
+	cv.BGR2Lab,
+	-1,
+}
+
+func FuzzImageProcessing(f *testing.F) {
+	f.Add(uint8(5), uint8(5), uint8(8), uint8(8), uint8(0), uint8(2), uint8(0), uint8(1))
+	f.Add(uint8(5), uint8(4), uint8(7), uint8(9), uint8(5), uint8(0), uint8(2), uint8(3))
+	f.Add(uint8(1), uint8(5), uint8(8), uint8(8), uint8(0), uint8(0), uint8(5), uint8(0))
+	f.Fuzz(func(t *testing.T, kindSrc, kindDst, w, h, depth, channels, shift, code uint8) {
+		src := fuzzArr(t, kindSrc, w, h, depth, channels)
+		dst := fuzzArr(t, kindDst, w+shift%2, h, depth+shift/2%2, channels+shift/4%2)
+		half := fuzzArr(t, kindDst, w/2, h/2, depth, channels)
+		gray := fuzzArr(t, kindDst, w, h, depth, 0)
+		checkCall(t, "Threshold", func() error {
+			_, err := cv.Threshold(src, dst, 1, 255, cv.THRESH_BINARY)
+			return err
+		})
+		checkCall(t, "CvtColor", func() error {
+			return cv.CvtColor(src, dst, fuzzColorCodes[int(code)%len(fuzzColorCodes)])
+		})
+		checkCall(t, "Split", func() error { return cv.Split(src, gray, dst, nil, nil) })
+		checkCall(t, "PyrDown", func() error { return cv.PyrDown(src, half, cv.GAUSSIAN_5x5) })
+		checkCall(t, "PyrUp", func() error { return cv.PyrUp(half, src, cv.GAUSSIAN_5x5) })
+		checkCall(t, "Dilate", func() error { return cv.Dilate(src, dst, nil, int(code%3)) })
+		checkCall(t, "Erode", func() error { return cv.Erode(src, dst, nil, int(code%3)) })
+		checkCall(t, "MorphologyEx", func() error {
+			return cv.MorphologyEx(src, dst, gray, nil, cv.MORPH_GRADIENT, 1)
+		})
+	})
+}
+
+func FuzzContour(f *testing.F) {
+	f.Add(uint8(5), uint8(8), uint8(8), uint8(0), uint8(0), uint8(0), true)
+	f.Add(uint8(4), uint8(1), uint8(2), uint8(4), uint8(0), uint8(1), false)
+	f.Add(uint8(3), uint8(8), uint8(8), uint8(0), uint8(0), uint8(0), true)
+	f.Fuzz(func(t *testing.T, kind, w, h, depth, channels, mode uint8, withStorage bool) {
+		img := fuzzArr(t, kind, w, h, depth, channels)
+		var storage *cv.MemStorage
+		if withStorage {
+			storage = cv.NewMemStorage(0)
+			t.Cleanup(storage.Release)
+		}
+		var contours cv.Seq
+		checkCall(t, "FindContours", func() error {
+			var err error
+			contours, err = cv.FindContours(img, storage, int(mode%4), cv.CHAIN_APPROX_SIMPLE, cv.Point{})
+			return err
+		})
+		// The contours found, if any, are valid input; the image itself is not
+		// a point set, and exercises the checks on the other path.
+		for _, c := range []cv.Arr{contours, img} {
+			checkCall(t, "ContourArea", func() error { _, err := cv.ContourArea(c, cv.WHOLE_SEQ, false); return err })
+			checkCall(t, "ArcLength", func() error { _, err := cv.ArcLength(c, cv.WHOLE_SEQ, -1); return err })
+			checkCall(t, "ConvexHull", func() error { _, err := cv.ConvexHull(c, cv.CLOCKWISE, 1); return err })
+			checkCall(t, "CheckContourConvexity", func() error { _, err := cv.CheckContourConvexity(c); return err })
+			checkCall(t, "BoundingRect", func() error { _, err := cv.BoundingRect(c); return err })
+		}
+		checkCall(t, "ApproxPoly", func() error {
+			_, err := cv.ApproxPoly(contours, storage, cv.POLY_APPROX_DP, 1, 0)
+			return err
+		})
+	})
+}
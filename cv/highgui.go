@@ -1,64 +1,144 @@
 package cv
 
-// #include "highgui.h"
+// #include "shim.h"
 import "C"
 
 import (
+	"context"
 	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"runtime"
+	"sync"
 	"time"
 	"unsafe"
 )
 
-// Capture is an image capture source.
+// Capture is an image capture source.  Captures are released automatically
+// when they are garbage collected, but Release may be called to close the
+// source sooner.
 type Capture struct {
+	// mu is held while the capture is in use, so that Release waits for a
+	// QueryFrame that was abandoned by its context.
+	mu      sync.Mutex
 	capture *C.CvCapture
 }
 
-// Release closes the capture source.
-func (c Capture) Release() {
-	do(func() {
+func newCapture(c *C.CvCapture) *Capture {
+	capture := &Capture{capture: c}
+	runtime.SetFinalizer(capture, (*Capture).finalize)
+	return capture
+}
+
+// Release closes the capture source.  Calling Release again is a no-op.
+func (c *Capture) Release() {
+	runtime.SetFinalizer(c, nil)
+	do(c.release)
+}
+
+func (c *Capture) release() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.capture != nil {
 		C.cvReleaseCapture(&c.capture)
-	})
+	}
 }
 
-// QueryFrame returns a new frame from the capture source.
-func (c Capture) QueryFrame() (*IplImage, error) {
+func (c *Capture) finalize() {
+	releaseLater(c.release)
+}
+
+// QueryFrame returns a new frame from the capture source.  The frame is owned
+// by the capture: it is only valid until the next call to QueryFrame and it
+// must not be modified.
+func (c *Capture) QueryFrame() (*IplImage, error) {
+	return c.QueryFrameContext(context.Background())
+}
+
+// QueryFrameContext is like QueryFrame, but stops waiting for the frame if ctx
+// is done first.  The frame is still read in the background, and Release waits
+// for it.
+func (c *Capture) QueryFrameContext(ctx context.Context) (*IplImage, error) {
 	var image *C.IplImage
-	do(func() {
-		image = C.cvQueryFrame(c.capture)
+	err := doErrContext(ctx, func() error {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		if c.capture == nil {
+			return errors.New("cv: QueryFrame: capture released")
+		}
+		image = C.try_cvQueryFrame(c.capture)
+		return nil
 	})
+	if err != nil {
+		return nil, err
+	}
 	if image == nil {
 		return nil, errors.New("query failed")
 	}
-	// XXX: The pointer to this memory should not be garbage collected.
-	return (*IplImage)(unsafe.Pointer(image)), nil
+	return &IplImage{ipl: image, borrowed: true, ref: c}, nil
 }
 
 // CaptureFromCAM creates a new capture source for the given device.
-func CaptureFromCAM(device int) (Capture, error) {
-	var c *C.CvCapture
-	do(func() {
-		c = C.cvCaptureFromCAM(C.int(device))
+func CaptureFromCAM(device int) (*Capture, error) {
+	return CaptureFromCAMContext(context.Background(), device)
+}
+
+// CaptureFromCAMContext is like CaptureFromCAM, but stops waiting for the
+// device to open if ctx is done first.
+func CaptureFromCAMContext(ctx context.Context, device int) (*Capture, error) {
+	return openCapture(ctx, func() *C.CvCapture {
+		return C.cvCaptureFromCAM(C.int(device))
 	})
-	if c == nil {
-		return Capture{}, errors.New("Capture failed")
-	}
-	return Capture{c}, nil
 }
 
 // CaptureFromFile creates a new capture source for a given file.
-func CaptureFromFile(filename string) (Capture, error) {
-	s := C.CString(filename)
-	defer C.free(unsafe.Pointer(s))
+func CaptureFromFile(filename string) (*Capture, error) {
+	return CaptureFromFileContext(context.Background(), filename)
+}
 
-	var c *C.CvCapture
-	do(func() {
-		c = C.cvCaptureFromFile(s)
+// CaptureFromFileContext is like CaptureFromFile, but stops waiting for the
+// file to open if ctx is done first.
+func CaptureFromFileContext(ctx context.Context, filename string) (*Capture, error) {
+	return openCapture(ctx, func() *C.CvCapture {
+		s := C.CString(filename)
+		defer C.free(unsafe.Pointer(s))
+		return C.cvCaptureFromFile(s)
 	})
+}
+
+// openCapture wraps the capture returned by open, which is called on a thread
+// that may make OpenCV calls.  If ctx is done before open returns, the capture
+// is released as soon as it is opened.
+func openCapture(ctx context.Context, open func() *C.CvCapture) (*Capture, error) {
+	var (
+		mu        sync.Mutex
+		c         *C.CvCapture
+		abandoned bool
+	)
+	err := doContext(ctx, func() {
+		capture := open()
+		mu.Lock()
+		defer mu.Unlock()
+		if abandoned {
+			if capture != nil {
+				C.cvReleaseCapture(&capture)
+			}
+			return
+		}
+		c = capture
+	})
+	mu.Lock()
+	defer mu.Unlock()
+	if err != nil && c == nil {
+		abandoned = true
+		return nil, err
+	}
 	if c == nil {
-		return Capture{}, errors.New("Capture failed")
+		return nil, errors.New("Capture failed")
 	}
-	return Capture{c}, nil
+	return newCapture(c), nil
 }
 
 const (
@@ -77,28 +157,166 @@ func LoadImage(name string, color int) (*IplImage, error) {
 		image = C.cvLoadImage(cname, C.int(color))
 	})
 	if image == nil {
-		return nil, errors.New("LoadImage failed")
+		if _, err := os.Stat(name); err != nil {
+			return nil, fmt.Errorf("cv: LoadImage: %w", err)
+		}
+		return nil, fmt.Errorf("cv: LoadImage %s: %w", name, errBadImage)
+	}
+	return newIplImage(image), nil
+}
+
+// LoadImageFS creates an image from the file called name in fsys.  Any format
+// supported by LoadImage may be used.
+func LoadImageFS(fsys fs.FS, name string, color int) (*IplImage, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, fmt.Errorf("cv: LoadImageFS: %w", err)
+	}
+	image := decodeImage(data, color)
+	if image == nil {
+		return nil, fmt.Errorf("cv: LoadImageFS %s: %w", name, errBadImage)
+	}
+	return image, nil
+}
+
+// DecodeImage creates an image from an in-memory image file.  Any format
+// supported by LoadImage may be used.
+func DecodeImage(data []byte, color int) (*IplImage, error) {
+	image := decodeImage(data, color)
+	if image == nil {
+		return nil, fmt.Errorf("cv: DecodeImage: %w", errBadImage)
+	}
+	return image, nil
+}
+
+// ReadImage creates an image from an image file read from r.  Any format
+// supported by LoadImage may be used.
+func ReadImage(r io.Reader, color int) (*IplImage, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("cv: ReadImage: %w", err)
+	}
+	image := decodeImage(data, color)
+	if image == nil {
+		return nil, fmt.Errorf("cv: ReadImage: %w", errBadImage)
 	}
-	return (*IplImage)(unsafe.Pointer(image)), nil
+	return image, nil
+}
+
+var errBadImage = errors.New("unrecognized or corrupt image data")
+
+// decodeImage returns the image decoded from data or nil if data could not be
+// decoded.
+func decodeImage(data []byte, color int) *IplImage {
+	if len(data) == 0 {
+		return nil
+	}
+
+	var pinner runtime.Pinner
+	pinner.Pin(&data[0])
+	defer pinner.Unpin()
+	var image *C.IplImage
+	do(func() {
+		buf := C.cvMat(1, C.int(len(data)), C.CV_8UC1, unsafe.Pointer(&data[0]))
+		image = C.cvDecodeImage(&buf, C.int(color))
+	})
+	return newIplImage(image)
+}
+
+// EncodeImage compresses img into an in-memory image file.  ext is a file
+// extension like ".png" or ".jpg" that selects the format.
+func EncodeImage(ext string, img Arr, params ...ImageParam) ([]byte, error) {
+	cext := C.CString(ext)
+	defer C.free(unsafe.Pointer(cext))
+	cparams := imageParams(params)
+
+	var data []byte
+	err := doErr(func() error {
+		m := C.try_cvEncodeImage(cext, img.arr(), &cparams[0])
+		if m == nil {
+			return nil
+		}
+		ptr := *(*unsafe.Pointer)(unsafe.Pointer(&m.data))
+		data = C.GoBytes(ptr, m.rows*m.cols)
+		C.cvReleaseMat(&m)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("cv: EncodeImage: cannot encode image as %q", ext)
+	}
+	return data, nil
+}
+
+// WriteImage compresses img and writes it to w.  ext and params are the same as
+// for EncodeImage.
+func WriteImage(w io.Writer, ext string, img Arr, params ...ImageParam) error {
+	data, err := EncodeImage(ext, img, params...)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(data)
+	return err
 }
 
 // ShowImage displays img to the window called name.
 func ShowImage(name string, img Arr) {
 	cname := C.CString(name)
 	defer C.free(unsafe.Pointer(cname))
-	do(func() {
+	doMain(func() {
 		C.cvShowImage(cname, img.arr())
 	})
 }
 
-// SaveImage saves img to file called name
-func SaveImage(name string, img Arr) {
+// ImageParamID identifies an image encoder parameter.
+type ImageParamID int
+
+// Image encoder parameters
+const (
+	IMWRITE_JPEG_QUALITY    ImageParamID = C.CV_IMWRITE_JPEG_QUALITY
+	IMWRITE_PNG_COMPRESSION ImageParamID = C.CV_IMWRITE_PNG_COMPRESSION
+	IMWRITE_PXM_BINARY      ImageParamID = C.CV_IMWRITE_PXM_BINARY
+)
+
+// ImageParam is an encoder parameter for SaveImage and EncodeImage.  JPEG
+// quality ranges from 0 to 100 (default 95), PNG compression ranges from 0 to 9
+// (default 3) and PXM binary is 0 or 1 (default 1).
+type ImageParam struct {
+	ID    ImageParamID
+	Value int
+}
+
+// imageParams converts encoder parameters into the zero-terminated list that
+// OpenCV expects.
+func imageParams(params []ImageParam) []C.int {
+	cparams := make([]C.int, 0, len(params)*2+1)
+	for _, p := range params {
+		cparams = append(cparams, C.int(p.ID), C.int(p.Value))
+	}
+	return append(cparams, 0)
+}
+
+// SaveImage saves img to file called name.  The format is chosen by the file's
+// extension.
+func SaveImage(name string, img Arr, params ...ImageParam) error {
 	cname := C.CString(name)
 	defer C.free(unsafe.Pointer(cname))
-	params := C.int(0)
-	do(func() {
-		C.cvSaveImage(cname, img.arr(), (*C.int)(&params))
+	cparams := imageParams(params)
+
+	var result C.int
+	err := doErr(func() error {
+		result = C.try_cvSaveImage(cname, img.arr(), &cparams[0])
+		return nil
 	})
+	if err != nil {
+		return err
+	}
+	if result == 0 {
+		return fmt.Errorf("cv: SaveImage %s: cannot write image", name)
+	}
+	return nil
 }
 
 // Window flags
@@ -111,7 +329,7 @@ func NamedWindow(name string, flags int) {
 	cname := C.CString(name)
 	defer C.free(unsafe.Pointer(cname))
 	// TODO: Check result
-	do(func() {
+	doMain(func() {
 		C.cvNamedWindow(cname, C.int(flags))
 	})
 }
@@ -119,18 +337,26 @@ func NamedWindow(name string, flags int) {
 // WaitKey obtains key input from the user. If delay is non-zero, then the
 // function will return if a key has not been hit before delay has elapsed.
 func WaitKey(delay time.Duration) rune {
+	key, _ := WaitKeyContext(context.Background(), delay)
+	return key
+}
+
+// WaitKeyContext is like WaitKey, but stops waiting if ctx is done first.  The
+// main thread stays busy until the underlying call returns, so a zero delay
+// should be avoided if other HighGUI calls are needed after cancellation.
+func WaitKeyContext(ctx context.Context, delay time.Duration) (rune, error) {
 	var key rune
-	do(func() {
+	err := doMainContext(ctx, func() {
 		key = rune(C.cvWaitKey(C.int(delay.Nanoseconds() / 1e6)))
 	})
-	return key
+	return key, err
 }
 
 // DestroyWindow will close the window called name.
 func DestroyWindow(name string) {
 	cname := C.CString(name)
 	defer C.free(unsafe.Pointer(cname))
-	do(func() {
+	doMain(func() {
 		C.cvDestroyWindow(cname)
 	})
 }
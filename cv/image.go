@@ -1,53 +1,235 @@
 package cv
 
-// #include "cv.h"
+// #include "shim.h"
 import "C"
 
 import (
+	"errors"
+	"fmt"
 	"image"
 	"image/color"
 	"reflect"
+	"runtime"
+	"sync"
 	"unsafe"
 )
 
-// IplImage stores an image.
+// IplImage stores an image.  Images created by this package are released
+// automatically when they are garbage collected, but Release may be called to
+// free the image's memory sooner.
 type IplImage struct {
-	NSize           int
-	ID              int
-	NChannels       int
-	AlphaChannel    int
-	Depth           int
-	ColorModel      [4]int8
-	ChannelSeq      [4]int8
-	DataOrder       int
-	Origin          int
-	Align           int
-	Width           int
-	Height          int
-	ROI             uintptr // TODO
-	MaskROI         *IplImage
-	ImageId         uintptr
-	TileInfo        uintptr // TODO
-	ImageSize       int
-	ImageData       uintptr // TODO
-	WidthStep       int
-	BorderMode      [4]int
-	BorderConst     [4]int
-	ImageDataOrigin uintptr // TODO
-}
-
-// NewImage creates a new image.
-func NewImage(size Size, depth, channels int) *IplImage {
-	// XXX: This should be garbage-collected by Go.
+	// mu is held while the image is being released.
+	mu  sync.Mutex
+	ipl *C.IplImage
+
+	// borrowed is true if the image's memory is owned by something else (like
+	// a Capture) and must not be released.
+	borrowed bool
+	// header is true if only the image header is owned by i, like images
+	// returned by SubImage.
+	header bool
+	// ref keeps the owner of a borrowed image or of a header's data reachable.
+	ref interface{}
+	// pinner pins the Go memory used by a header's data.
+	pinner *runtime.Pinner
+	// oldData is the buffer allocated by OpenCV that SetData replaced.
+	oldData unsafe.Pointer
+}
+
+// newIplImage returns a Go-owned handle for ipl, or nil if ipl is nil.
+func newIplImage(ipl *C.IplImage) *IplImage {
+	if ipl == nil {
+		return nil
+	}
+	i := &IplImage{ipl: ipl}
+	runtime.SetFinalizer(i, (*IplImage).finalize)
+	return i
+}
+
+// Depth is the bit depth and signedness of an image's channels.
+type Depth uint32
+
+// Image depths
+const (
+	IPL_DEPTH_1U  Depth = C.IPL_DEPTH_1U
+	IPL_DEPTH_8U  Depth = C.IPL_DEPTH_8U
+	IPL_DEPTH_8S  Depth = C.IPL_DEPTH_8S
+	IPL_DEPTH_16U Depth = C.IPL_DEPTH_16U
+	IPL_DEPTH_16S Depth = C.IPL_DEPTH_16S
+	IPL_DEPTH_32S Depth = C.IPL_DEPTH_32S
+	IPL_DEPTH_32F Depth = C.IPL_DEPTH_32F
+	IPL_DEPTH_64F Depth = C.IPL_DEPTH_64F
+)
+
+var depthNames = map[Depth]string{
+	IPL_DEPTH_1U:  "IPL_DEPTH_1U",
+	IPL_DEPTH_8U:  "IPL_DEPTH_8U",
+	IPL_DEPTH_8S:  "IPL_DEPTH_8S",
+	IPL_DEPTH_16U: "IPL_DEPTH_16U",
+	IPL_DEPTH_16S: "IPL_DEPTH_16S",
+	IPL_DEPTH_32S: "IPL_DEPTH_32S",
+	IPL_DEPTH_32F: "IPL_DEPTH_32F",
+	IPL_DEPTH_64F: "IPL_DEPTH_64F",
+}
+
+func (d Depth) String() string {
+	if name, ok := depthNames[d]; ok {
+		return name
+	}
+	return fmt.Sprintf("Depth(%#x)", uint32(d))
+}
+
+// Bits returns the number of bits in each channel.
+func (d Depth) Bits() int {
+	return int(d & 0xff)
+}
+
+// ByteSize returns the number of bytes needed to store each channel.
+func (d Depth) ByteSize() int {
+	return (d.Bits() + 7) / 8
+}
+
+// Signed reports whether the depth holds signed integers.
+func (d Depth) Signed() bool {
+	return d&C.IPL_DEPTH_SIGN != 0
+}
+
+// NewImage creates a new image.  Images must have between one and four
+// channels.  IPL_DEPTH_1U is not supported, since OpenCV can't store images
+// with less than a byte per channel.
+func NewImage(size Size, depth Depth, channels int) (*IplImage, error) {
+	if err := checkImageFormat(size, depth, channels); err != nil {
+		return nil, fmt.Errorf("cv: NewImage: %v", err)
+	}
+	return createImage(size, depth, channels), nil
+}
+
+// NewImageHeader creates an image that uses data as its pixel buffer instead of
+// copying it.  widthStep is the number of bytes per row of data, which must
+// hold at least height*widthStep bytes.  data is kept alive and pinned until
+// the image is released, and it must not be resized or reused in the meantime.
+func NewImageHeader(size Size, depth Depth, channels int, data []byte, widthStep int) (*IplImage, error) {
+	if err := checkImageFormat(size, depth, channels); err != nil {
+		return nil, fmt.Errorf("cv: NewImageHeader: %v", err)
+	}
+	if err := checkData(size.Height, (size.Width*channels*depth.Bits()+7)/8, data, widthStep); err != nil {
+		return nil, fmt.Errorf("cv: NewImageHeader: %v", err)
+	}
+
+	// OpenCV holds on to the pointer after cvSetData returns, so the memory
+	// must be pinned.
+	pinner := new(runtime.Pinner)
+	pinner.Pin(&data[0])
+	var hdr *C.IplImage
+	do(func() {
+		hdr = C.cvCreateImageHeader(C.CvSize{C.int(size.Width), C.int(size.Height)}, C.int(depth), C.int(channels))
+		C.cvSetData(unsafe.Pointer(hdr), unsafe.Pointer(&data[0]), C.int(widthStep))
+	})
+	i := &IplImage{ipl: hdr, header: true, ref: data, pinner: pinner}
+	runtime.SetFinalizer(i, (*IplImage).finalize)
+	return i, nil
+}
+
+// checkImageFormat returns an error if OpenCV cannot create an image with the
+// given format.
+func checkImageFormat(size Size, depth Depth, channels int) error {
+	if _, ok := depthNames[depth]; !ok || depth == IPL_DEPTH_1U {
+		return fmt.Errorf("unsupported depth %v", depth)
+	}
+	if channels < 1 || channels > 4 {
+		return fmt.Errorf("unsupported %d-channel image with depth %v", channels, depth)
+	}
+	if size.Width < 0 || size.Height < 0 {
+		return fmt.Errorf("negative size %v", size)
+	}
+	return nil
+}
+
+// checkData returns an error if data, with rows widthStep bytes apart, cannot
+// hold height rows of rowSize bytes.
+func checkData(height, rowSize int, data []byte, widthStep int) error {
+	if widthStep < rowSize {
+		return fmt.Errorf("width step %d is smaller than row size %d", widthStep, rowSize)
+	}
+	if n := height * widthStep; len(data) < n || len(data) == 0 {
+		return fmt.Errorf("got %d bytes, need %d", len(data), n)
+	}
+	return nil
+}
+
+// setData implements SetData for images.
+func (i *IplImage) setData(data []byte, widthStep int) error {
+	if i.borrowed {
+		return errors.New("cv: SetData: image is owned by a capture")
+	}
+	if err := checkData(i.Height(), (i.Width()*i.NChannels()*i.Depth().Bits()+7)/8, data, widthStep); err != nil {
+		return fmt.Errorf("cv: SetData: %v", err)
+	}
+	pinner := new(runtime.Pinner)
+	pinner.Pin(&data[0])
+	err := doErr(func() error {
+		if !i.header {
+			// Headers over other memory may still point into the image's own
+			// buffer, so it is kept until the image is released.
+			i.oldData = unsafe.Pointer(i.ipl.imageDataOrigin)
+			i.header = true
+		}
+		C.try_cvSetData(i.arr(), unsafe.Pointer(&data[0]), C.int(widthStep))
+		return nil
+	})
+	if err != nil {
+		pinner.Unpin()
+		return err
+	}
+	if i.pinner != nil {
+		i.pinner.Unpin()
+	}
+	i.ref, i.pinner = data, pinner
+	return nil
+}
+
+// createImage creates a new image without validating its arguments.
+func createImage(size Size, depth Depth, channels int) *IplImage {
 	var i *C.IplImage
 	do(func() {
 		i = C.cvCreateImage(C.CvSize{C.int(size.Width), C.int(size.Height)}, C.int(depth), C.int(channels))
 	})
-	return (*IplImage)(unsafe.Pointer(i))
+	return newIplImage(i)
 }
 
 func (i *IplImage) arr() unsafe.Pointer {
-	return unsafe.Pointer(i)
+	return unsafe.Pointer(i.ipl)
+}
+
+// NChannels returns the number of channels in the image.
+func (i *IplImage) NChannels() int {
+	return int(i.ipl.nChannels)
+}
+
+// Depth returns the depth of the image's channels.
+func (i *IplImage) Depth() Depth {
+	return Depth(uint32(i.ipl.depth))
+}
+
+// Width returns the width of the image in pixels.
+func (i *IplImage) Width() int {
+	return int(i.ipl.width)
+}
+
+// Height returns the height of the image in pixels.
+func (i *IplImage) Height() int {
+	return int(i.ipl.height)
+}
+
+// WidthStep returns the number of bytes in each row of the image.
+func (i *IplImage) WidthStep() int {
+	return int(i.ipl.widthStep)
+}
+
+// Origin returns zero if the image has a top-left origin or one if the image
+// has a bottom-left origin.
+func (i *IplImage) Origin() int {
+	return int(i.ipl.origin)
 }
 
 // Size returns the width and height of the image.
@@ -63,31 +245,368 @@ func (i *IplImage) Size() Size {
 func (i *IplImage) Clone() *IplImage {
 	var ii *C.IplImage
 	do(func() {
-		ii = C.cvCloneImage((*C.IplImage)(unsafe.Pointer(i)))
+		ii = C.cvCloneImage(i.ipl)
 	})
-	return (*IplImage)(unsafe.Pointer(ii))
+	return newIplImage(ii)
 }
 
 // SetCOI sets the image's channel of interest.
 func (i *IplImage) SetCOI(channel int) {
 	do(func() {
-		C.cvSetImageCOI((*C.IplImage)(unsafe.Pointer(i)), C.int(channel))
+		C.cvSetImageCOI(i.ipl, C.int(channel))
+	})
+}
+
+// SetROI sets the image's region of interest.  r is clipped to the image, and
+// an error is returned if nothing is left.
+func (i *IplImage) SetROI(r Rect) error {
+	return doErr(func() error {
+		C.try_cvSetImageROI(i.ipl, C.CvRect{C.int(r.X), C.int(r.Y), C.int(r.Width), C.int(r.Height)})
+		return nil
+	})
+}
+
+// GetROI returns the image's region of interest.  If no region of interest is
+// set, the whole image is returned.
+func (i *IplImage) GetROI() Rect {
+	var r C.CvRect
+	do(func() {
+		r = C.cvGetImageROI(i.ipl)
 	})
+	return Rect{int(r.x), int(r.y), int(r.width), int(r.height)}
 }
 
-// SetROI sets the image's region of interest.
-func (i *IplImage) SetROI(r Rect) {
+// ResetROI clears the image's region of interest so that the whole image is
+// used.
+func (i *IplImage) ResetROI() {
 	do(func() {
-		C.cvSetImageROI((*C.IplImage)(unsafe.Pointer(i)),
-			C.CvRect{C.int(r.X), C.int(r.Y), C.int(r.Width), C.int(r.Height)})
+		C.cvResetImageROI(i.ipl)
 	})
 }
 
-// Release destroys the memory associated with the image.
-func (i *IplImage) Release() {
+// GetCOI returns the image's channel of interest.  Channels are numbered
+// starting at one; zero means that all channels are selected.
+func (i *IplImage) GetCOI() int {
+	var coi C.int
 	do(func() {
-		C.cvReleaseImage((**C.IplImage)(unsafe.Pointer(&i)))
+		coi = C.cvGetImageCOI(i.ipl)
 	})
+	return int(coi)
+}
+
+// SubImage returns an image that shares the pixels inside r with i.  r is
+// relative to i's region of interest and must lie within it.  The returned
+// image has its own region of interest and channel of interest, so it can be
+// used independently of i, and it keeps i's pixels alive.
+func (i *IplImage) SubImage(r Rect) *IplImage {
+	bd := i.Bounds()
+	sub := image.Rect(bd.Min.X+r.X, bd.Min.Y+r.Y, bd.Min.X+r.X+r.Width, bd.Min.Y+r.Y+r.Height)
+	if r.Width <= 0 || r.Height <= 0 || !sub.In(bd) {
+		panic("cv: SubImage rectangle out of bounds")
+	}
+	offset := sub.Min.Y*i.WidthStep() + sub.Min.X*i.pixelSize()
+
+	var hdr *C.IplImage
+	do(func() {
+		hdr = C.cvCreateImageHeader(C.CvSize{C.int(r.Width), C.int(r.Height)}, i.ipl.depth, i.ipl.nChannels)
+		hdr.origin = i.ipl.origin
+		C.cvSetData(unsafe.Pointer(hdr), unsafe.Pointer(uintptr(unsafe.Pointer(i.ipl.imageData))+uintptr(offset)), i.ipl.widthStep)
+	})
+	si := &IplImage{ipl: hdr, header: true, ref: i}
+	runtime.SetFinalizer(si, (*IplImage).finalize)
+	return si
+}
+
+// Release destroys the memory associated with the image.  The image must not
+// be used after it is released, but calling Release again is a no-op.
+func (i *IplImage) Release() {
+	runtime.SetFinalizer(i, nil)
+	do(i.release)
+}
+
+func (i *IplImage) release() {
+	// Release may be called from several goroutines at once when calls are
+	// served by workers or run directly.
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.ipl == nil {
+		return
+	}
+	switch {
+	case i.borrowed:
+	case i.header:
+		C.cvReleaseImageHeader(&i.ipl)
+	default:
+		C.cvReleaseImage(&i.ipl)
+	}
+	i.ipl, i.ref = nil, nil
+	if i.pinner != nil {
+		i.pinner.Unpin()
+		i.pinner = nil
+	}
+	if i.oldData != nil {
+		C.cvFree_(i.oldData)
+		i.oldData = nil
+	}
+}
+
+func (i *IplImage) finalize() {
+	releaseLater(i.release)
+}
+
+// Bounds returns the image's region of interest, or the whole image if no
+// region of interest is set.  It is part of the image.Image interface.
+func (i *IplImage) Bounds() image.Rectangle {
+	if roi := i.ipl.roi; roi != nil {
+		return image.Rect(int(roi.xOffset), int(roi.yOffset), int(roi.xOffset+roi.width), int(roi.yOffset+roi.height))
+	}
+	return image.Rect(0, 0, i.Width(), i.Height())
+}
+
+// ColorModel returns the image's color model.  Only 8-bit images with one,
+// three or four channels can be used as an image.Image.
+func (i *IplImage) ColorModel() color.Model {
+	switch i.pixelFormat() {
+	case 1:
+		return color.GrayModel
+	case 3:
+		return color.RGBAModel
+	default:
+		return color.NRGBAModel
+	}
+}
+
+// At returns the color of the pixel at (x, y).  Three-channel images are
+// treated as opaque BGR and four-channel images as non-premultiplied BGRA.
+func (i *IplImage) At(x, y int) color.Color {
+	defer runtime.KeepAlive(i)
+	nchannels := i.pixelFormat()
+	if !image.Pt(x, y).In(i.Bounds()) {
+		switch nchannels {
+		case 1:
+			return color.Gray{}
+		case 3:
+			return color.RGBA{}
+		}
+		return color.NRGBA{}
+	}
+	p := i.data()[y*i.WidthStep()+x*nchannels:]
+	switch nchannels {
+	case 1:
+		return color.Gray{p[0]}
+	case 3:
+		return color.RGBA{p[2], p[1], p[0], 0xff}
+	default:
+		return color.NRGBA{p[2], p[1], p[0], p[3]}
+	}
+}
+
+// Set changes the color of the pixel at (x, y).  It is part of the draw.Image
+// interface.
+func (i *IplImage) Set(x, y int, c color.Color) {
+	defer runtime.KeepAlive(i)
+	nchannels := i.pixelFormat()
+	if !image.Pt(x, y).In(i.Bounds()) {
+		return
+	}
+	p := i.data()[y*i.WidthStep()+x*nchannels:]
+	switch nchannels {
+	case 1:
+		p[0] = color.GrayModel.Convert(c).(color.Gray).Y
+	case 3:
+		r, g, b, _ := c.RGBA()
+		p[0], p[1], p[2] = byte(b>>8), byte(g>>8), byte(r>>8)
+	default:
+		nc := color.NRGBAModel.Convert(c).(color.NRGBA)
+		p[0], p[1], p[2], p[3] = nc.B, nc.G, nc.R, nc.A
+	}
+}
+
+// pixelFormat returns the number of channels in the image, panicking if the
+// image cannot be used as an image.Image.
+func (i *IplImage) pixelFormat() int {
+	n := i.NChannels()
+	if i.Depth() != IPL_DEPTH_8U || (n != 1 && n != 3 && n != 4) {
+		panic("cv: image.Image requires an 8-bit image with 1, 3 or 4 channels")
+	}
+	return n
+}
+
+// data returns the image's pixel buffer without copying.
+func (i *IplImage) data() []byte {
+	return cBytes(unsafe.Pointer(i.ipl.imageData), int(i.ipl.imageSize))
+}
+
+// Bytes returns the pixel data of the image's region of interest without
+// copying.  The slice starts at the region's first pixel and ends after its
+// last pixel, with rows WidthStep bytes apart.
+//
+// The slice points into memory owned by the image and does not keep the image
+// alive.  The image is released when it is garbage collected, so the caller
+// must keep i reachable for as long as the slice is used, for example by
+// calling runtime.KeepAlive(i) after the last use.  The slice must not be used
+// after the image is released.  Pixels returns a copy that has neither
+// restriction.
+func (i *IplImage) Bytes() []byte {
+	bd := i.Bounds()
+	if bd.Empty() {
+		return nil
+	}
+	step, psize := i.WidthStep(), i.pixelSize()
+	return i.data()[bd.Min.Y*step+bd.Min.X*psize : (bd.Max.Y-1)*step+bd.Max.X*psize]
+}
+
+// Row returns the pixel data of row y of the image's region of interest
+// without copying.  y is relative to the top of the region of interest.  As
+// with Bytes, the caller must keep i reachable while the slice is used, and the
+// slice must not be used after the image is released.
+func (i *IplImage) Row(y int) []byte {
+	bd := i.Bounds()
+	if y < 0 || y >= bd.Dy() {
+		panic("cv: image row out of range")
+	}
+	start := (bd.Min.Y+y)*i.WidthStep() + bd.Min.X*i.pixelSize()
+	return i.data()[start : start+bd.Dx()*i.pixelSize()]
+}
+
+// Pixels returns a copy of the pixel data of the image's region of interest,
+// with the rows packed one after another.  Unlike Bytes, the copy is ordinary
+// Go memory, so it stays valid after the image is released.
+func (i *IplImage) Pixels() []byte {
+	defer runtime.KeepAlive(i)
+	bd := i.Bounds()
+	n := bd.Dx() * i.pixelSize()
+	pix := make([]byte, 0, n*bd.Dy())
+	for y := 0; y < bd.Dy(); y++ {
+		pix = append(pix, i.Row(y)...)
+	}
+	return pix
+}
+
+// Uint16Row is like Row, but for IPL_DEPTH_16U images.
+func (i *IplImage) Uint16Row(y int) []uint16 {
+	i.checkDepth("Uint16Row", IPL_DEPTH_16U)
+	return uint16s(i.Row(y))
+}
+
+// Float32Row is like Row, but for IPL_DEPTH_32F images.
+func (i *IplImage) Float32Row(y int) []float32 {
+	i.checkDepth("Float32Row", IPL_DEPTH_32F)
+	return float32s(i.Row(y))
+}
+
+// Float64Row is like Row, but for IPL_DEPTH_64F images.
+func (i *IplImage) Float64Row(y int) []float64 {
+	i.checkDepth("Float64Row", IPL_DEPTH_64F)
+	return float64s(i.Row(y))
+}
+
+func (i *IplImage) checkDepth(name string, depth Depth) {
+	if i.Depth() != depth {
+		panic(fmt.Sprintf("cv: %s called on image with depth %v", name, i.Depth()))
+	}
+}
+
+// pixelSize returns the number of bytes in each pixel.
+func (i *IplImage) pixelSize() int {
+	return i.Depth().ByteSize() * i.NChannels()
+}
+
+// ToImage copies the image's region of interest into the closest type from the
+// image package: *image.Gray, *image.Gray16, *image.RGBA, *image.NRGBA,
+// *image.RGBA64 or *image.NRGBA64.  Only unsigned 8-bit and 16-bit images with
+// one, three or four channels can be converted.  Three-channel images are
+// treated as opaque BGR and four-channel images as non-premultiplied BGRA.
+func (i *IplImage) ToImage() (image.Image, error) {
+	// data points into C memory, so keep i from being finalized while it is
+	// being copied.
+	defer runtime.KeepAlive(i)
+	bd := i.Bounds()
+	data, step := i.data(), i.WidthStep()
+	nchannels, w := i.NChannels(), bd.Dx()
+	switch i.Depth() {
+	case IPL_DEPTH_8U:
+		switch nchannels {
+		case 1:
+			m := image.NewGray(bd)
+			for y := bd.Min.Y; y < bd.Max.Y; y++ {
+				copy(m.Pix[m.PixOffset(bd.Min.X, y):], data[y*step+bd.Min.X:y*step+bd.Max.X])
+			}
+			return m, nil
+		case 3:
+			m := image.NewRGBA(bd)
+			for y := bd.Min.Y; y < bd.Max.Y; y++ {
+				src, dst := data[y*step+bd.Min.X*3:], m.Pix[m.PixOffset(bd.Min.X, y):]
+				for x := 0; x < w; x++ {
+					dst[x*4+0] = src[x*3+2]
+					dst[x*4+1] = src[x*3+1]
+					dst[x*4+2] = src[x*3+0]
+					dst[x*4+3] = 0xff
+				}
+			}
+			return m, nil
+		case 4:
+			m := image.NewNRGBA(bd)
+			for y := bd.Min.Y; y < bd.Max.Y; y++ {
+				src, dst := data[y*step+bd.Min.X*4:], m.Pix[m.PixOffset(bd.Min.X, y):]
+				for x := 0; x < w; x++ {
+					dst[x*4+0] = src[x*4+2]
+					dst[x*4+1] = src[x*4+1]
+					dst[x*4+2] = src[x*4+0]
+					dst[x*4+3] = src[x*4+3]
+				}
+			}
+			return m, nil
+		}
+	case IPL_DEPTH_16U:
+		switch nchannels {
+		case 1:
+			m := image.NewGray16(bd)
+			for y := bd.Min.Y; y < bd.Max.Y; y++ {
+				src, dst := uint16s(data[y*step+bd.Min.X*2:]), m.Pix[m.PixOffset(bd.Min.X, y):]
+				for x := 0; x < w; x++ {
+					putUint16(dst[x*2:], src[x])
+				}
+			}
+			return m, nil
+		case 3:
+			m := image.NewRGBA64(bd)
+			for y := bd.Min.Y; y < bd.Max.Y; y++ {
+				src, dst := uint16s(data[y*step+bd.Min.X*6:]), m.Pix[m.PixOffset(bd.Min.X, y):]
+				for x := 0; x < w; x++ {
+					putUint16(dst[x*8+0:], src[x*3+2])
+					putUint16(dst[x*8+2:], src[x*3+1])
+					putUint16(dst[x*8+4:], src[x*3+0])
+					putUint16(dst[x*8+6:], 0xffff)
+				}
+			}
+			return m, nil
+		case 4:
+			m := image.NewNRGBA64(bd)
+			for y := bd.Min.Y; y < bd.Max.Y; y++ {
+				src, dst := uint16s(data[y*step+bd.Min.X*8:]), m.Pix[m.PixOffset(bd.Min.X, y):]
+				for x := 0; x < w; x++ {
+					putUint16(dst[x*8+0:], src[x*4+2])
+					putUint16(dst[x*8+2:], src[x*4+1])
+					putUint16(dst[x*8+4:], src[x*4+0])
+					putUint16(dst[x*8+6:], src[x*4+3])
+				}
+			}
+			return m, nil
+		}
+	}
+	return nil, fmt.Errorf("cv: cannot convert image with depth %v and %d channels", i.Depth(), nchannels)
+}
+
+// getUint16 loads a value from b in the big-endian order used by the image
+// package.
+func getUint16(b []byte) uint16 {
+	return uint16(b[0])<<8 | uint16(b[1])
+}
+
+// putUint16 stores v in b in the big-endian order used by the image package.
+func putUint16(b []byte, v uint16) {
+	b[0], b[1] = byte(v>>8), byte(v)
 }
 
 // ConvertImage converts a Go image (from the image package) into an IplImage.
@@ -96,92 +615,232 @@ func ConvertImage(m image.Image) *IplImage {
 	const nchannels = 3
 
 	bd := m.Bounds()
-	msize := bd.Size()
+	ipl := createImage(Size{bd.Dx(), bd.Dy()}, IPL_DEPTH_8U, nchannels)
+	switch m := m.(type) {
+	case *image.RGBA:
+		convertRGB(ipl, m)
+	case *image.YCbCr:
+		convertYCbCr(ipl, m)
+	default:
+		data, step := ipl.data(), ipl.WidthStep()
+		for y := 0; y < bd.Dy(); y++ {
+			row := data[y*step:]
+			for x := 0; x < bd.Dx(); x++ {
+				r, g, b, _ := m.At(bd.Min.X+x, bd.Min.Y+y).RGBA()
+				row[x*nchannels+0] = byte(b >> 8)
+				row[x*nchannels+1] = byte(g >> 8)
+				row[x*nchannels+2] = byte(r >> 8)
+			}
+		}
+	}
+	return ipl
+}
+
+// ConvertImageNative converts a Go image (from the image package) into an
+// IplImage, keeping the source's channel count and bit depth.  Gray images
+// become one-channel images, RGBA and NRGBA images become non-premultiplied
+// four-channel BGRA images and 16-bit images become IPL_DEPTH_16U images.
+// YCbCr images are converted the same way as ConvertImage does and any other
+// image becomes an 8-bit BGRA image.
+func ConvertImageNative(m image.Image) *IplImage {
+	bd := m.Bounds()
+	size := Size{bd.Dx(), bd.Dy()}
 
-	data := cvAlloc(msize.X * msize.Y * nchannels)
+	var ipl *IplImage
 	switch m := m.(type) {
+	case *image.Gray:
+		ipl = createImage(size, IPL_DEPTH_8U, 1)
+		convertGray(ipl, m)
+	case *image.Gray16:
+		ipl = createImage(size, IPL_DEPTH_16U, 1)
+		convertGray16(ipl, m)
 	case *image.RGBA:
-		convertRGB(data, m)
+		ipl = createImage(size, IPL_DEPTH_8U, 4)
+		convertRGBA(ipl, m)
+	case *image.NRGBA:
+		ipl = createImage(size, IPL_DEPTH_8U, 4)
+		convertNRGBA(ipl, m)
+	case *image.RGBA64:
+		ipl = createImage(size, IPL_DEPTH_16U, 4)
+		convertRGBA64(ipl, m)
+	case *image.NRGBA64:
+		ipl = createImage(size, IPL_DEPTH_16U, 4)
+		convertNRGBA64(ipl, m)
 	case *image.YCbCr:
-		convertYCbCr(data, m)
+		return ConvertImage(m)
 	default:
-		for y := bd.Min.Y; y < bd.Max.Y; y++ {
-			for x := bd.Min.X; x < bd.Max.X; x++ {
-				r, g, b, _ := m.At(x, y).RGBA()
-				data[(y*msize.X+x)*nchannels+0] = byte(b >> 8)
-				data[(y*msize.X+x)*nchannels+1] = byte(g >> 8)
-				data[(y*msize.X+x)*nchannels+2] = byte(r >> 8)
+		ipl = createImage(size, IPL_DEPTH_8U, 4)
+		data, step := ipl.data(), ipl.WidthStep()
+		for y := 0; y < size.Height; y++ {
+			row := data[y*step:]
+			for x := 0; x < size.Width; x++ {
+				c := color.NRGBAModel.Convert(m.At(bd.Min.X+x, bd.Min.Y+y)).(color.NRGBA)
+				row[x*4+0] = c.B
+				row[x*4+1] = c.G
+				row[x*4+2] = c.R
+				row[x*4+3] = c.A
 			}
 		}
 	}
-	ipl := NewImage(Size{msize.X, msize.Y}, 8, nchannels)
-	do(func() {
-		C.cvReleaseData(ipl.arr())
-		C.cvSetData(ipl.arr(), unsafe.Pointer(&data[0]), C.int(msize.X*nchannels))
-	})
 	return ipl
 }
 
-func convertRGB(data []byte, rgb *image.RGBA) {
-	const nchannels = 3
-	bd := rgb.Bounds()
-	msize := bd.Size()
-	for y := 0; y < msize.Y; y++ {
-		for x := 0; x < msize.X; x++ {
-			i := y*rgb.Stride + x*4
-			data[(y*msize.X+x)*nchannels+0] = rgb.Pix[i+2]
-			data[(y*msize.X+x)*nchannels+1] = rgb.Pix[i+1]
-			data[(y*msize.X+x)*nchannels+2] = rgb.Pix[i+0]
+func convertGray(ipl *IplImage, gray *image.Gray) {
+	bd := gray.Bounds()
+	data, step := ipl.data(), ipl.WidthStep()
+	for y := 0; y < bd.Dy(); y++ {
+		i := gray.PixOffset(bd.Min.X, bd.Min.Y+y)
+		copy(data[y*step:y*step+bd.Dx()], gray.Pix[i:])
+	}
+}
+
+func convertGray16(ipl *IplImage, gray *image.Gray16) {
+	bd := gray.Bounds()
+	data, step := ipl.data(), ipl.WidthStep()
+	for y := 0; y < bd.Dy(); y++ {
+		row := uint16s(data[y*step:])
+		src := gray.Pix[gray.PixOffset(bd.Min.X, bd.Min.Y+y):]
+		for x := 0; x < bd.Dx(); x++ {
+			row[x] = getUint16(src[x*2:])
 		}
 	}
 }
 
-func convertYCbCr(data []byte, ycbcr *image.YCbCr) {
-	const nchannels = 3
-	bd := ycbcr.Rect
-	msize := bd.Size()
-	switch ycbcr.SubsampleRatio {
-	case image.YCbCrSubsampleRatio422:
-		for y := 0; y < msize.Y; y++ {
-			for x := 0; x < msize.X; x++ {
-				i := (y-bd.Min.Y)*ycbcr.CStride + (x/2 - bd.Min.X/2)
-				r, g, b := color.YCbCrToRGB(ycbcr.Y[y*ycbcr.YStride+x], ycbcr.Cb[i], ycbcr.Cr[i])
-				data[(y*msize.X+x)*nchannels+0] = b
-				data[(y*msize.X+x)*nchannels+1] = g
-				data[(y*msize.X+x)*nchannels+2] = r
+func convertRGBA(ipl *IplImage, rgba *image.RGBA) {
+	bd := rgba.Bounds()
+	data, step := ipl.data(), ipl.WidthStep()
+	for y := 0; y < bd.Dy(); y++ {
+		row := data[y*step:]
+		src := rgba.Pix[rgba.PixOffset(bd.Min.X, bd.Min.Y+y):]
+		for x := 0; x < bd.Dx(); x++ {
+			r, g, b, a := uint32(src[x*4+0]), uint32(src[x*4+1]), uint32(src[x*4+2]), uint32(src[x*4+3])
+			if a != 0 && a != 0xff {
+				r, g, b = r*0xff/a, g*0xff/a, b*0xff/a
 			}
+			row[x*4+0] = byte(b)
+			row[x*4+1] = byte(g)
+			row[x*4+2] = byte(r)
+			row[x*4+3] = byte(a)
 		}
-	case image.YCbCrSubsampleRatio420:
-		for y := 0; y < msize.Y; y++ {
-			for x := 0; x < msize.X; x++ {
-				i := (y/2-bd.Min.Y/2)*ycbcr.CStride + (x/2 - bd.Min.X/2)
-				r, g, b := color.YCbCrToRGB(ycbcr.Y[y*ycbcr.YStride+x], ycbcr.Cb[i], ycbcr.Cr[i])
-				data[(y*msize.X+x)*nchannels+0] = b
-				data[(y*msize.X+x)*nchannels+1] = g
-				data[(y*msize.X+x)*nchannels+2] = r
-			}
+	}
+}
+
+func convertNRGBA(ipl *IplImage, nrgba *image.NRGBA) {
+	bd := nrgba.Bounds()
+	data, step := ipl.data(), ipl.WidthStep()
+	for y := 0; y < bd.Dy(); y++ {
+		row := data[y*step:]
+		src := nrgba.Pix[nrgba.PixOffset(bd.Min.X, bd.Min.Y+y):]
+		for x := 0; x < bd.Dx(); x++ {
+			row[x*4+0] = src[x*4+2]
+			row[x*4+1] = src[x*4+1]
+			row[x*4+2] = src[x*4+0]
+			row[x*4+3] = src[x*4+3]
 		}
-	default:
-		for y := 0; y < msize.Y; y++ {
-			for x := 0; x < msize.X; x++ {
-				i := (y-bd.Min.Y)*ycbcr.CStride + (x - bd.Min.X)
-				r, g, b := color.YCbCrToRGB(ycbcr.Y[y*ycbcr.YStride+x], ycbcr.Cb[i], ycbcr.Cr[i])
-				data[(y*msize.X+x)*nchannels+0] = b
-				data[(y*msize.X+x)*nchannels+1] = g
-				data[(y*msize.X+x)*nchannels+2] = r
+	}
+}
+
+func convertRGBA64(ipl *IplImage, rgba *image.RGBA64) {
+	bd := rgba.Bounds()
+	data, step := ipl.data(), ipl.WidthStep()
+	for y := 0; y < bd.Dy(); y++ {
+		row := uint16s(data[y*step:])
+		src := rgba.Pix[rgba.PixOffset(bd.Min.X, bd.Min.Y+y):]
+		for x := 0; x < bd.Dx(); x++ {
+			r, g, b := uint32(getUint16(src[x*8+0:])), uint32(getUint16(src[x*8+2:])), uint32(getUint16(src[x*8+4:]))
+			a := uint32(getUint16(src[x*8+6:]))
+			if a != 0 && a != 0xffff {
+				r, g, b = r*0xffff/a, g*0xffff/a, b*0xffff/a
 			}
+			row[x*4+0] = uint16(b)
+			row[x*4+1] = uint16(g)
+			row[x*4+2] = uint16(r)
+			row[x*4+3] = uint16(a)
 		}
 	}
 }
 
-func cvAlloc(n int) []byte {
-	var ptr unsafe.Pointer
-	do(func() {
-		ptr = unsafe.Pointer(C.cvAlloc(C.size_t(n)))
-	})
+func convertNRGBA64(ipl *IplImage, nrgba *image.NRGBA64) {
+	bd := nrgba.Bounds()
+	data, step := ipl.data(), ipl.WidthStep()
+	for y := 0; y < bd.Dy(); y++ {
+		row := uint16s(data[y*step:])
+		src := nrgba.Pix[nrgba.PixOffset(bd.Min.X, bd.Min.Y+y):]
+		for x := 0; x < bd.Dx(); x++ {
+			row[x*4+0] = getUint16(src[x*8+4:])
+			row[x*4+1] = getUint16(src[x*8+2:])
+			row[x*4+2] = getUint16(src[x*8+0:])
+			row[x*4+3] = getUint16(src[x*8+6:])
+		}
+	}
+}
+
+func convertRGB(ipl *IplImage, rgb *image.RGBA) {
+	const nchannels = 3
+	bd := rgb.Bounds()
+	data, step := ipl.data(), ipl.WidthStep()
+	for y := 0; y < bd.Dy(); y++ {
+		row := data[y*step:]
+		src := rgb.Pix[rgb.PixOffset(bd.Min.X, bd.Min.Y+y):]
+		for x := 0; x < bd.Dx(); x++ {
+			row[x*nchannels+0] = src[x*4+2]
+			row[x*nchannels+1] = src[x*4+1]
+			row[x*nchannels+2] = src[x*4+0]
+		}
+	}
+}
+
+// convertYCbCr converts ycbcr to BGR.  YOffset and COffset account for the
+// image's origin and chroma subsampling, so every subsample ratio is handled.
+func convertYCbCr(ipl *IplImage, ycbcr *image.YCbCr) {
+	const nchannels = 3
+	bd := ycbcr.Rect
+	data, step := ipl.data(), ipl.WidthStep()
+	for y := 0; y < bd.Dy(); y++ {
+		row := data[y*step:]
+		for x := 0; x < bd.Dx(); x++ {
+			yi := ycbcr.YOffset(bd.Min.X+x, bd.Min.Y+y)
+			ci := ycbcr.COffset(bd.Min.X+x, bd.Min.Y+y)
+			r, g, b := color.YCbCrToRGB(ycbcr.Y[yi], ycbcr.Cb[ci], ycbcr.Cr[ci])
+			row[x*nchannels+0] = b
+			row[x*nchannels+1] = g
+			row[x*nchannels+2] = r
+		}
+	}
+}
+
+// cBytes returns a slice that refers to n bytes of C memory starting at ptr.
+func cBytes(ptr unsafe.Pointer, n int) []byte {
 	if ptr == nil {
 		return nil
 	}
 	slice := reflect.SliceHeader{Data: uintptr(ptr), Len: n, Cap: n}
 	return *(*[]byte)(unsafe.Pointer(&slice))
 }
+
+// uint16s reinterprets b as a slice of native-endian uint16s.
+func uint16s(b []byte) []uint16 {
+	if len(b) < 2 {
+		return nil
+	}
+	slice := reflect.SliceHeader{Data: uintptr(unsafe.Pointer(&b[0])), Len: len(b) / 2, Cap: len(b) / 2}
+	return *(*[]uint16)(unsafe.Pointer(&slice))
+}
+
+// float32s reinterprets b as a slice of float32s.
+func float32s(b []byte) []float32 {
+	if len(b) < 4 {
+		return nil
+	}
+	slice := reflect.SliceHeader{Data: uintptr(unsafe.Pointer(&b[0])), Len: len(b) / 4, Cap: len(b) / 4}
+	return *(*[]float32)(unsafe.Pointer(&slice))
+}
+
+// float64s reinterprets b as a slice of float64s.
+func float64s(b []byte) []float64 {
+	if len(b) < 8 {
+		return nil
+	}
+	slice := reflect.SliceHeader{Data: uintptr(unsafe.Pointer(&b[0])), Len: len(b) / 8, Cap: len(b) / 8}
+	return *(*[]float64)(unsafe.Pointer(&slice))
+}
@@ -0,0 +1,122 @@
+package cv_test
+
+import (
+	"image"
+	"image/color"
+	"testing"
+
+	"bitbucket.org/zombiezen/gocv/cv"
+)
+
+func TestConvertImageYCbCr(t *testing.T) {
+	ratios := []struct {
+		name  string
+		ratio image.YCbCrSubsampleRatio
+	}{
+		{"444", image.YCbCrSubsampleRatio444},
+		{"422", image.YCbCrSubsampleRatio422},
+		{"420", image.YCbCrSubsampleRatio420},
+		{"440", image.YCbCrSubsampleRatio440},
+		{"411", image.YCbCrSubsampleRatio411},
+		{"410", image.YCbCrSubsampleRatio410},
+	}
+	// The odd origin doesn't line up with any of the chroma blocks.
+	r := image.Rect(3, 5, 21, 17)
+	for _, test := range ratios {
+		t.Run(test.name, func(t *testing.T) {
+			t.Run("NewYCbCr", func(t *testing.T) {
+				checkConvertYCbCr(t, newYCbCr(r, test.ratio))
+			})
+			t.Run("SubImage", func(t *testing.T) {
+				m := newYCbCr(image.Rect(0, 0, 32, 24), test.ratio)
+				checkConvertYCbCr(t, m.SubImage(r).(*image.YCbCr))
+			})
+		})
+	}
+}
+
+// newYCbCr returns an image whose planes hold distinct patterns, so that
+// reading the wrong sample shows up as a wrong color.
+func newYCbCr(r image.Rectangle, ratio image.YCbCrSubsampleRatio) *image.YCbCr {
+	m := image.NewYCbCr(r, ratio)
+	for i := range m.Y {
+		m.Y[i] = byte(16 + i*7%220)
+	}
+	for i := range m.Cb {
+		m.Cb[i] = byte(16 + i*13%224)
+		m.Cr[i] = byte(240 - i*11%224)
+	}
+	return m
+}
+
+func checkConvertYCbCr(t *testing.T, m *image.YCbCr) {
+	t.Helper()
+	checkConvert(t, m, func(x, y int) (r, g, b uint8) {
+		c := m.YCbCrAt(x, y)
+		return color.YCbCrToRGB(c.Y, c.Cb, c.Cr)
+	})
+}
+
+func TestConvertImageSubImage(t *testing.T) {
+	r := image.Rect(3, 5, 21, 17)
+	rgba := image.NewRGBA(image.Rect(0, 0, 32, 24))
+	for i := range rgba.Pix {
+		if i%4 == 3 {
+			rgba.Pix[i] = 0xff
+		} else {
+			rgba.Pix[i] = byte(i * 7)
+		}
+	}
+	gray := image.NewGray(image.Rect(0, 0, 32, 24))
+	for i := range gray.Pix {
+		gray.Pix[i] = byte(i * 7)
+	}
+	tests := []struct {
+		name string
+		m    image.Image
+		want func(x, y int) (r, g, b uint8)
+	}{
+		{
+			name: "RGBA",
+			m:    rgba.SubImage(r),
+			want: func(x, y int) (r, g, b uint8) {
+				c := rgba.RGBAAt(x, y)
+				return c.R, c.G, c.B
+			},
+		},
+		{
+			name: "Gray",
+			m:    gray.SubImage(r),
+			want: func(x, y int) (r, g, b uint8) {
+				c := gray.GrayAt(x, y)
+				return c.Y, c.Y, c.Y
+			},
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			checkConvert(t, test.m, test.want)
+		})
+	}
+}
+
+// checkConvert checks that ConvertImage gives the BGR form of the colors that
+// want returns for each pixel of m.
+func checkConvert(t *testing.T, m image.Image, want func(x, y int) (r, g, b uint8)) {
+	t.Helper()
+	img := cv.ConvertImage(m)
+	defer img.Release()
+	bd := m.Bounds()
+	if got := img.Bounds(); got != image.Rect(0, 0, bd.Dx(), bd.Dy()) {
+		t.Fatalf("Bounds() = %v; want %v", got, image.Rect(0, 0, bd.Dx(), bd.Dy()))
+	}
+	for y := bd.Min.Y; y < bd.Max.Y; y++ {
+		for x := bd.Min.X; x < bd.Max.X; x++ {
+			r, g, b := want(x, y)
+			c := img.At(x-bd.Min.X, y-bd.Min.Y).(color.RGBA)
+			if c.R != r || c.G != g || c.B != b {
+				t.Fatalf("pixel (%d, %d) = RGB(%d, %d, %d); want RGB(%d, %d, %d)", x, y, c.R, c.G, c.B, r, g, b)
+			}
+		}
+	}
+}
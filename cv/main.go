@@ -1,7 +1,22 @@
 package cv
 
+/*
+// dispatchThread is set on the threads that serve OpenCV calls: 1 on the
+// thread serving Main or Start and 2 on worker threads.
+static __thread int dispatchThread;
+
+static void setDispatchThread(int v) { dispatchThread = v; }
+static int getDispatchThread(void) { return dispatchThread; }
+*/
+import "C"
+
 import (
+	"context"
 	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 // OpenCV has some issues with multiple threads.  To overcome this, we use a sneaky approach documented here:
@@ -11,20 +26,397 @@ func init() {
 	runtime.LockOSThread()
 }
 
-// Main must be called from the program's main function.
+// Main serves OpenCV calls on the main OS thread until Stop is called.  It
+// must be called from the program's main function if HighGUI windows are used.
 func Main() {
-	for f := range mainfunc {
+	serve()
+}
+
+// Run calls f on a new goroutine while the calling goroutine serves OpenCV
+// calls, and returns once f returns.  Like Main, it must be called from the
+// program's main function.
+func Run(f func()) {
+	go func() {
+		defer Stop()
+		f()
+	}()
+	Main()
+}
+
+// Start serves OpenCV calls from a new goroutine locked to its own OS thread,
+// so that the package can be used without calling Main.  This is meant for
+// tests and libraries that don't need HighGUI windows, which must be served
+// from the main thread on some platforms.  Start must not be used together
+// with Main or Run.
+func Start() {
+	go func() {
+		runtime.LockOSThread()
+		serve()
+	}()
+}
+
+// Stop makes the running Main or Start loop return once the call it is serving
+// finishes.  It must not be called from inside an OpenCV call.
+func Stop() {
+	stopfunc <- struct{}{}
+}
+
+var (
+	mainfunc = make(chan func())
+	stopfunc = make(chan struct{})
+)
+
+func serve() {
+	C.setDispatchThread(mainThread)
+	defer C.setDispatchThread(0)
+	for {
+		select {
+		case f := <-mainfunc:
+			call(f)
+		case <-releaseReady:
+			runReleases()
+		case <-stopfunc:
+			return
+		}
+	}
+}
+
+// releases holds the release functions queued by finalizers.
+var releases struct {
+	sync.Mutex
+	fs []func()
+}
+
+// releaseReady has a value while releases is not empty.
+var releaseReady = make(chan struct{}, 1)
+
+// releaseLater arranges for f to free an object whose finalizer has run.
+// Finalizers must not wait for a thread to serve the call, since none might be
+// running, so f is queued for the next thread that serves calls instead.  If
+// calls run directly, f is called right away.
+func releaseLater(f func()) {
+	if p, _ := workers.Load().(*pool); p != nil && p.work == nil {
 		f()
+		return
+	}
+	releases.Lock()
+	releases.fs = append(releases.fs, f)
+	releases.Unlock()
+	select {
+	case releaseReady <- struct{}{}:
+	default:
 	}
 }
 
-var mainfunc = make(chan func())
+// runReleases calls the functions queued by releaseLater.
+func runReleases() {
+	releases.Lock()
+	fs := releases.fs
+	releases.fs = nil
+	releases.Unlock()
+	for _, f := range fs {
+		f()
+	}
+}
+
+// SetWorkers configures where OpenCV calls that don't need the main thread are
+// run.  HighGUI window functions and WaitKey are always served by Main.
+//
+// If n is zero, which is the default, every call is served by Main or Start.
+// If n is positive, calls are served in parallel by n goroutines, each locked
+// to its own OS thread.  If n is negative, calls run directly on the calling
+// goroutine.  SetWorkers may be called at any time: calls that are already
+// waiting for the previous workers are served by them before they stop.  It
+// must not be called from inside an OpenCV call.
+func SetWorkers(n int) {
+	var p *pool
+	switch {
+	case n < 0:
+		p = new(pool)
+	case n > 0:
+		p = &pool{work: make(chan func()), quit: make(chan struct{})}
+		for i := 0; i < n; i++ {
+			go p.serve()
+		}
+	}
+	old, _ := workers.Load().(*pool)
+	workers.Store(p)
+	if old != nil && old.quit != nil {
+		old.stop()
+	}
+}
+
+// workers holds the *pool used by do.  A nil pool sends calls to the main
+// thread.
+var workers atomic.Value
+
+// pool is a set of worker threads.  A pool with a nil work channel runs calls
+// directly.
+type pool struct {
+	work chan func()
+	quit chan struct{}
+
+	// mu is held for reading while a call is being handed to a worker, so
+	// that stop can wait for those calls.
+	mu      sync.RWMutex
+	stopped bool
+}
+
+// send passes f to one of p's workers.  It returns false if p has stopped.
+func (p *pool) send(ctx context.Context, f func()) (bool, error) {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+	if p.stopped {
+		return false, nil
+	}
+	return true, sendChan(ctx, p.work, f)
+}
+
+// stop makes p's workers exit once the calls being handed to them have been
+// received.
+func (p *pool) stop() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stopped = true
+	close(p.quit)
+}
+
+func (p *pool) serve() {
+	runtime.LockOSThread()
+	C.setDispatchThread(workerThread)
+	defer C.setDispatchThread(0)
+	for {
+		select {
+		case f := <-p.work:
+			call(f)
+		case <-releaseReady:
+			runReleases()
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// Values of dispatchThread
+const (
+	mainThread   = 1
+	workerThread = 2
+)
+
+// Batch runs f on a thread that may make OpenCV calls and waits for it to
+// finish.  OpenCV calls made by f run directly on that thread instead of being
+// dispatched one at a time, which saves a thread switch per call.  That switch
+// can cost more than the call itself for small calls, like measuring each of
+// thousands of contours.
+// HighGUI calls made by f still run on the main thread.
+func Batch(f func()) {
+	do(batch(f))
+}
+
+// BatchContext is like Batch, but stops waiting if ctx is done first.  If f
+// has not started by then, it is never run.  If f has started, it keeps running
+// in the background.  BatchContext returns ctx.Err() if it stops waiting.
+func BatchContext(ctx context.Context, f func()) error {
+	return doContext(ctx, batch(f))
+}
+
+// batches counts the Batch functions that are running, so that direct only
+// asks which thread it is on while one might be.
+var batches int32
+
+func batch(f func()) func() {
+	return func() {
+		atomic.AddInt32(&batches, 1)
+		defer atomic.AddInt32(&batches, -1)
+		f()
+	}
+}
 
+// SetSlowCallHandler arranges for h to be called with the name of the calling
+// function whenever an OpenCV call runs for longer than threshold.  h is called
+// on its own goroutine.  A nil h turns reporting off.
+func SetSlowCallHandler(threshold time.Duration, h func(name string, d time.Duration)) {
+	if h == nil {
+		slowCalls.Store((*slowCallHandler)(nil))
+		return
+	}
+	slowCalls.Store(&slowCallHandler{threshold, h})
+}
+
+// slowCalls holds the current *slowCallHandler.
+var slowCalls atomic.Value
+
+type slowCallHandler struct {
+	threshold time.Duration
+	h         func(name string, d time.Duration)
+}
+
+// wrap returns a function that calls f and reports it if it is slow.
+func (s *slowCallHandler) wrap(f func()) func() {
+	name := callerName()
+	return func() {
+		start := time.Now()
+		f()
+		if d := time.Since(start); d > s.threshold {
+			go s.h(name, d)
+		}
+	}
+}
+
+// callerName returns the name of the function that called into the
+// dispatcher.
+func callerName() string {
+	pc := make([]uintptr, 16)
+	frames := runtime.CallersFrames(pc[:runtime.Callers(3, pc)])
+	for {
+		frame, more := frames.Next()
+		name := frame.Function[strings.LastIndex(frame.Function, "/")+1:]
+		switch name {
+		case "cv.do", "cv.doErr", "cv.doErrContext", "cv.doMain", "cv.doContext", "cv.doMainContext", "cv.run", "cv.runContext", "cv.Batch", "cv.BatchContext":
+		default:
+			return name
+		}
+		if !more {
+			return name
+		}
+	}
+}
+
+// do runs f on a thread that may make OpenCV calls and waits for it to finish.
 func do(f func()) {
+	run(false, f)
+}
+
+// doMain is like do, but always runs f on the thread serving Main.  It must be
+// used for HighGUI calls.
+func doMain(f func()) {
+	run(true, f)
+}
+
+// doContext is like do, but stops waiting if ctx is done first.
+func doContext(ctx context.Context, f func()) error {
+	return runContext(ctx, false, f)
+}
+
+// doMainContext is like doMain, but stops waiting if ctx is done first.
+func doMainContext(ctx context.Context, f func()) error {
+	return runContext(ctx, true, f)
+}
+
+// run sends f to the thread that serves calls for do, or for doMain if main is
+// true, and waits for it to finish.  If the calling thread can make the call
+// itself, f is called directly.
+func run(main bool, f func()) {
+	if s, _ := slowCalls.Load().(*slowCallHandler); s != nil {
+		f = s.wrap(f)
+	}
+	if direct(main) {
+		call(f)
+		return
+	}
 	done := make(chan struct{})
-	mainfunc <- func() {
+	g := func() {
 		f()
 		close(done)
 	}
+	if sent, _ := send(context.Background(), main, g); !sent {
+		call(g)
+		return
+	}
 	<-done
 }
+
+// runContext is like run, but stops waiting if ctx is done first.
+func runContext(ctx context.Context, main bool, f func()) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	if s, _ := slowCalls.Load().(*slowCallHandler); s != nil {
+		f = s.wrap(f)
+	}
+	if direct(main) {
+		call(f)
+		return nil
+	}
+
+	// started is set by whichever of the serving thread and this goroutine
+	// gets to it first, so that f is never run after runContext gives up.
+	var started int32
+	done := make(chan struct{})
+	g := func() {
+		if !atomic.CompareAndSwapInt32(&started, 0, 1) {
+			return
+		}
+		f()
+		close(done)
+	}
+	sent, err := send(ctx, main, g)
+	if err != nil {
+		return err
+	}
+	if !sent {
+		call(g)
+		return nil
+	}
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		atomic.CompareAndSwapInt32(&started, 0, 1)
+		return ctx.Err()
+	}
+}
+
+// direct reports whether calls for do, or for doMain if main is true, are
+// made on the calling goroutine.
+func direct(main bool) bool {
+	if main {
+		return C.getDispatchThread() == mainThread
+	}
+	if atomic.LoadInt32(&batches) != 0 && C.getDispatchThread() != 0 {
+		// Already inside a Batch.
+		return true
+	}
+	p, _ := workers.Load().(*pool)
+	return p != nil && p.work == nil
+}
+
+// send passes f to the thread that serves calls for do, or for doMain if main
+// is true.  It returns false without calling f if the calls should be made
+// directly instead, which can happen if SetWorkers was called since direct
+// was checked.  It returns ctx.Err() if ctx is done before f is handed off.
+func send(ctx context.Context, main bool, f func()) (sent bool, err error) {
+	if main {
+		return true, sendChan(ctx, mainfunc, f)
+	}
+	for {
+		p, _ := workers.Load().(*pool)
+		switch {
+		case p == nil:
+			return true, sendChan(ctx, mainfunc, f)
+		case p.work == nil:
+			return false, nil
+		}
+		if ok, err := p.send(ctx, f); ok {
+			return true, err
+		}
+		// SetWorkers replaced p; use the new pool.
+	}
+}
+
+func sendChan(ctx context.Context, ch chan<- func(), f func()) error {
+	select {
+	case ch <- f:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// call calls f and keeps it alive until it returns.  OpenCV calls read the
+// arrays captured by f, and nothing else may be keeping them reachable, so
+// without this an array's finalizer could free it during the call.
+func call(f func()) {
+	f()
+	runtime.KeepAlive(f)
+}
@@ -0,0 +1,189 @@
+package cv_test
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+
+	"bitbucket.org/zombiezen/gocv/cv"
+)
+
+func TestMain(m *testing.M) {
+	cv.Start()
+	os.Exit(m.Run())
+}
+
+// newImage creates an image for a test and releases it when the test ends.
+func newImage(tb testing.TB, w, h int, depth cv.Depth, channels int) *cv.IplImage {
+	tb.Helper()
+	img, err := cv.NewImage(cv.Size{Width: w, Height: h}, depth, channels)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(img.Release)
+	return img
+}
+
+// BenchmarkWorkers measures the throughput of a moderately expensive call made
+// from many goroutines for different numbers of workers.  With one worker or
+// the main thread, calls are serialized; with more, throughput should scale
+// with the number of cores.
+func BenchmarkWorkers(b *testing.B) {
+	counts := []int{0, 1, 2, 4, runtime.NumCPU(), -1}
+	for _, n := range counts {
+		name := fmt.Sprintf("workers=%d", n)
+		switch {
+		case n == 0:
+			name = "main"
+		case n < 0:
+			name = "direct"
+		}
+		b.Run(name, func(b *testing.B) {
+			cv.SetWorkers(n)
+			defer cv.SetWorkers(0)
+			b.RunParallel(func(pb *testing.PB) {
+				// Each goroutine uses its own images, so that the calls are
+				// independent.
+				src, err := cv.NewImage(cv.Size{Width: 640, Height: 480}, cv.IPL_DEPTH_8U, 1)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer src.Release()
+				dst, err := cv.NewImage(cv.Size{Width: 640, Height: 480}, cv.IPL_DEPTH_8U, 1)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				defer dst.Release()
+				for pb.Next() {
+					if err := cv.Dilate(src, dst, nil, 2); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
+
+// TestSetWorkersWhileBusy checks that replacing the workers doesn't strand
+// callers that are waiting for the old ones.
+func TestSetWorkersWhileBusy(t *testing.T) {
+	defer cv.SetWorkers(0)
+	cv.SetWorkers(1)
+	src := newImage(t, 64, 64, cv.IPL_DEPTH_8U, 1)
+	const callers = 8
+	dsts := make([]*cv.IplImage, callers)
+	for i := range dsts {
+		dsts[i] = newImage(t, 64, 64, cv.IPL_DEPTH_8U, 1)
+	}
+
+	// Hold the only worker, so that the callers have to wait for it.
+	started, hold := make(chan struct{}), make(chan struct{})
+	unhold := sync.OnceFunc(func() { close(hold) })
+	defer unhold()
+	go cv.Do(func() {
+		close(started)
+		<-hold
+	})
+	<-started
+	done := make(chan error)
+	for _, dst := range dsts {
+		go func(dst *cv.IplImage) {
+			done <- cv.Dilate(src, dst, nil, 1)
+		}(dst)
+	}
+	// Give the callers time to start waiting for the old worker.
+	time.Sleep(10 * time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("call finished while the worker was held: %v", err)
+	default:
+	}
+
+	swapped := make(chan struct{})
+	go func() {
+		cv.SetWorkers(2)
+		close(swapped)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	unhold()
+	timeout := time.After(10 * time.Second)
+	for i := 0; i < callers; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Error(err)
+			}
+		case <-timeout:
+			t.Fatal("callers waiting for the old worker were stranded")
+		}
+	}
+	<-swapped
+}
+
+// gridContours finds the contours of a grid of small squares, giving n*n
+// contours.
+func gridContours(tb testing.TB, n int) []cv.Seq {
+	tb.Helper()
+	img := newImage(tb, n*8, n*8, cv.IPL_DEPTH_8U, 1)
+	for y := 0; y < n*8; y++ {
+		row := img.Row(y)
+		for x := range row {
+			if x%8 >= 2 && x%8 < 6 && y%8 >= 2 && y%8 < 6 {
+				row[x] = 255
+			} else {
+				row[x] = 0
+			}
+		}
+	}
+	runtime.KeepAlive(img)
+	storage := cv.NewMemStorage(0)
+	tb.Cleanup(storage.Release)
+	first, err := cv.FindContours(img, storage, cv.RETR_LIST, cv.CHAIN_APPROX_SIMPLE, cv.Point{})
+	if err != nil {
+		tb.Fatal(err)
+	}
+	var contours []cv.Seq
+	for s := first; !s.IsZero(); s = s.Next() {
+		contours = append(contours, s)
+	}
+	if len(contours) != n*n {
+		tb.Fatalf("found %d contours, want %d", len(contours), n*n)
+	}
+	return contours
+}
+
+// BenchmarkContourArea compares measuring many contours with one dispatch per
+// call against measuring them all inside a single Batch.
+func BenchmarkContourArea(b *testing.B) {
+	contours := gridContours(b, 64)
+	b.Run("PerCall", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			for _, c := range contours {
+				if _, err := cv.ContourArea(c, cv.WHOLE_SEQ, false); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+	b.Run("Batch", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			var err error
+			cv.Batch(func() {
+				for _, c := range contours {
+					if _, err = cv.ContourArea(c, cv.WHOLE_SEQ, false); err != nil {
+						return
+					}
+				}
+			})
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
@@ -0,0 +1,300 @@
+package cv
+
+// #include "shim.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// MatType is the element type of a matrix: its depth and number of channels.
+type MatType int
+
+// Matrix element types
+const (
+	CV_8UC1 MatType = C.CV_8UC1
+	CV_8UC2 MatType = C.CV_8UC2
+	CV_8UC3 MatType = C.CV_8UC3
+	CV_8UC4 MatType = C.CV_8UC4
+
+	CV_8SC1 MatType = C.CV_8SC1
+	CV_8SC2 MatType = C.CV_8SC2
+	CV_8SC3 MatType = C.CV_8SC3
+	CV_8SC4 MatType = C.CV_8SC4
+
+	CV_16UC1 MatType = C.CV_16UC1
+	CV_16UC2 MatType = C.CV_16UC2
+	CV_16UC3 MatType = C.CV_16UC3
+	CV_16UC4 MatType = C.CV_16UC4
+
+	CV_16SC1 MatType = C.CV_16SC1
+	CV_16SC2 MatType = C.CV_16SC2
+	CV_16SC3 MatType = C.CV_16SC3
+	CV_16SC4 MatType = C.CV_16SC4
+
+	CV_32SC1 MatType = C.CV_32SC1
+	CV_32SC2 MatType = C.CV_32SC2
+	CV_32SC3 MatType = C.CV_32SC3
+	CV_32SC4 MatType = C.CV_32SC4
+
+	CV_32FC1 MatType = C.CV_32FC1
+	CV_32FC2 MatType = C.CV_32FC2
+	CV_32FC3 MatType = C.CV_32FC3
+	CV_32FC4 MatType = C.CV_32FC4
+
+	CV_64FC1 MatType = C.CV_64FC1
+	CV_64FC2 MatType = C.CV_64FC2
+	CV_64FC3 MatType = C.CV_64FC3
+	CV_64FC4 MatType = C.CV_64FC4
+)
+
+// Channels returns the number of channels in each element.
+func (t MatType) Channels() int {
+	return int(t)>>C.CV_CN_SHIFT&(C.CV_CN_MAX-1) + 1
+}
+
+// ElemSize returns the number of bytes in each element.
+func (t MatType) ElemSize() int {
+	depthSizes := [...]int{1, 1, 2, 2, 4, 4, 8, 0}
+	return depthSizes[int(t)&C.CV_MAT_DEPTH_MASK] * t.Channels()
+}
+
+// withChannels returns the type with t's depth and n channels.
+func (t MatType) withChannels(n int) MatType {
+	return MatType(int(t)&C.CV_MAT_DEPTH_MASK | (n-1)<<C.CV_CN_SHIFT)
+}
+
+// Mat is a two-dimensional OpenCV matrix.  Matrices are released
+// automatically when they are garbage collected, but Release may be called to
+// free the matrix's memory sooner.
+type Mat struct {
+	// mu is held while the matrix is being released.
+	mu sync.Mutex
+	m  *C.CvMat
+	// ref keeps the owner of a header's data reachable.
+	ref interface{}
+	// pinner pins the Go memory given to SetData.
+	pinner *runtime.Pinner
+}
+
+func newMat(m *C.CvMat, ref interface{}) *Mat {
+	if m == nil {
+		return nil
+	}
+	mat := &Mat{m: m, ref: ref}
+	runtime.SetFinalizer(mat, (*Mat).finalize)
+	return mat
+}
+
+// NewMat creates a new matrix.  rows and cols must be positive.
+func NewMat(rows, cols int, typ MatType) (*Mat, error) {
+	if rows <= 0 || cols <= 0 {
+		return nil, fmt.Errorf("cv: NewMat: matrix size %dx%d must be positive", cols, rows)
+	}
+	if err := checkMatType(typ); err != nil {
+		return nil, fmt.Errorf("cv: NewMat: %v", err)
+	}
+	var m *C.CvMat
+	err := doErr(func() error {
+		m = C.try_cvCreateMat(C.int(rows), C.int(cols), C.int(typ))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newMat(m, nil), nil
+}
+
+// checkMatType returns an error if typ is not a matrix type that OpenCV can
+// allocate.
+func checkMatType(typ MatType) error {
+	if typ < 0 || typ&^C.CV_MAT_TYPE_MASK != 0 || typeDepth(typ) == C.CV_USRTYPE1 {
+		return fmt.Errorf("unsupported matrix type %d", int(typ))
+	}
+	return nil
+}
+
+// NewMatFromFloat64s creates a CV_64FC1 matrix with a copy of data.  Every row
+// of data must have the same length.
+func NewMatFromFloat64s(data [][]float64) (*Mat, error) {
+	if len(data) == 0 || len(data[0]) == 0 {
+		return nil, errors.New("cv: NewMatFromFloat64s: empty matrix")
+	}
+	cols := len(data[0])
+	for i := range data {
+		if len(data[i]) != cols {
+			return nil, fmt.Errorf("cv: NewMatFromFloat64s: row %d has %d columns, expected %d", i, len(data[i]), cols)
+		}
+	}
+	m, err := NewMat(len(data), cols, CV_64FC1)
+	if err != nil {
+		return nil, err
+	}
+	for i := range data {
+		copy(m.row(i), data[i])
+	}
+	return m, nil
+}
+
+// GetMat returns a matrix header for arr that shares arr's data.  If arr is
+// an image, the matrix covers the image's region of interest.  If arr is
+// already a *Mat, it is returned as is.
+func GetMat(arr Arr) (*Mat, error) {
+	if isNilArr(arr) {
+		return nil, errors.New("cv: GetMat: array is nil or released")
+	}
+	switch arr := arr.(type) {
+	case *Mat:
+		return arr, nil
+	case Seq:
+		return nil, errors.New("cv: GetMat: sequences cannot be converted to matrices")
+	case *SparseMat:
+		return nil, errors.New("cv: GetMat: sparse matrices cannot be converted to matrices")
+	}
+	var m *C.CvMat
+	err := doErr(func() error {
+		var coi C.int
+		m = C.cvCreateMatHeader(1, 1, C.CV_8UC1)
+		if C.try_cvGetMat(arr.arr(), m, &coi, 0) == nil {
+			C.cvReleaseMat(&m)
+			return errors.New("cv: GetMat: array cannot be converted to a matrix")
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return newMat(m, arr), nil
+}
+
+func (m *Mat) arr() unsafe.Pointer {
+	return unsafe.Pointer(m.m)
+}
+
+// Rows returns the number of rows in the matrix.
+func (m *Mat) Rows() int {
+	return int(m.m.rows)
+}
+
+// Cols returns the number of columns in the matrix.
+func (m *Mat) Cols() int {
+	return int(m.m.cols)
+}
+
+// Type returns the matrix's element type.
+func (m *Mat) Type() MatType {
+	return MatType(m.m._type & C.CV_MAT_TYPE_MASK)
+}
+
+// Step returns the number of bytes in each row of the matrix.
+func (m *Mat) Step() int {
+	if m.m.step == 0 {
+		return m.Cols() * m.Type().ElemSize()
+	}
+	return int(m.m.step)
+}
+
+// Size returns the number of columns and rows in the matrix.
+func (m *Mat) Size() Size {
+	return Size{m.Cols(), m.Rows()}
+}
+
+// Image returns an image header that shares the matrix's data.
+func (m *Mat) Image() *IplImage {
+	var hdr *C.IplImage
+	do(func() {
+		hdr = C.cvCreateImageHeader(C.CvSize{1, 1}, C.IPL_DEPTH_8U, 1)
+		C.cvGetImage(m.arr(), hdr)
+	})
+	i := &IplImage{ipl: hdr, header: true, ref: m}
+	runtime.SetFinalizer(i, (*IplImage).finalize)
+	return i
+}
+
+// Float64s returns a copy of the matrix's elements.  Channels are interleaved,
+// so each row has Cols() * Type().Channels() values.
+func (m *Mat) Float64s() ([][]float64, error) {
+	// The rows are read from C memory after the last use of m.
+	defer runtime.KeepAlive(m)
+	src := m
+	if m.Type()&C.CV_MAT_DEPTH_MASK != C.CV_64F {
+		var err error
+		src, err = NewMat(m.Rows(), m.Cols(), CV_64FC1.withChannels(m.Type().Channels()))
+		if err != nil {
+			return nil, err
+		}
+		defer src.Release()
+		if err := ConvertScale(m, src, 1, 0); err != nil {
+			return nil, err
+		}
+	}
+	data := make([][]float64, src.Rows())
+	for i := range data {
+		data[i] = append([]float64(nil), src.row(i)...)
+	}
+	return data, nil
+}
+
+// setData implements SetData for matrices.
+func (m *Mat) setData(data []byte, widthStep int) error {
+	if err := checkData(m.Rows(), m.Cols()*m.Type().ElemSize(), data, widthStep); err != nil {
+		return fmt.Errorf("cv: SetData: %v", err)
+	}
+	pinner := new(runtime.Pinner)
+	pinner.Pin(&data[0])
+	// The matrix's own buffer, if any, is still freed through its reference
+	// count when the matrix is released.
+	err := doErr(func() error {
+		C.try_cvSetData(m.arr(), unsafe.Pointer(&data[0]), C.int(widthStep))
+		return nil
+	})
+	if err != nil {
+		pinner.Unpin()
+		return err
+	}
+	if m.pinner != nil {
+		m.pinner.Unpin()
+	}
+	m.ref, m.pinner = data, pinner
+	return nil
+}
+
+// row returns row i of a CV_64F matrix without copying.
+func (m *Mat) row(i int) []float64 {
+	n := m.Cols() * m.Type().Channels()
+	return float64s(cBytes(unsafe.Pointer(uintptr(m.dataPtr())+uintptr(i*m.Step())), n*8))
+}
+
+// dataPtr returns the address of the matrix's first element.
+func (m *Mat) dataPtr() unsafe.Pointer {
+	return *(*unsafe.Pointer)(unsafe.Pointer(&m.m.data))
+}
+
+// Release destroys the memory associated with the matrix.  The matrix must not
+// be used after it is released, but calling Release again is a no-op.
+func (m *Mat) Release() {
+	runtime.SetFinalizer(m, nil)
+	do(m.release)
+}
+
+func (m *Mat) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.m == nil {
+		return
+	}
+	C.cvReleaseMat(&m.m)
+	m.ref = nil
+	if m.pinner != nil {
+		m.pinner.Unpin()
+		m.pinner = nil
+	}
+}
+
+func (m *Mat) finalize() {
+	releaseLater(m.release)
+}
@@ -0,0 +1,366 @@
+package cv
+
+// #include "shim.h"
+import "C"
+
+import (
+	"errors"
+	"fmt"
+	"runtime"
+	"sync"
+	"unsafe"
+)
+
+// MatND is a dense n-dimensional OpenCV matrix.  Matrices are released
+// automatically when they are garbage collected, but Release may be called to
+// free the matrix's memory sooner.
+type MatND struct {
+	// mu is held while the matrix is being released.
+	mu sync.Mutex
+	m  *C.CvMatND
+}
+
+// NewMatND creates a new n-dimensional matrix with the given size in each
+// dimension.
+func NewMatND(sizes []int, typ MatType) (*MatND, error) {
+	csizes, err := cSizes(sizes)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMatType(typ); err != nil {
+		return nil, fmt.Errorf("cv: NewMatND: %v", err)
+	}
+	var m *C.CvMatND
+	err = doErr(func() error {
+		m = C.try_cvCreateMatND(C.int(len(sizes)), &csizes[0], C.int(typ))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	mat := &MatND{m: m}
+	runtime.SetFinalizer(mat, (*MatND).finalize)
+	return mat, nil
+}
+
+// NewMatNDFromFloat64s creates a CV_64FC1 matrix with a copy of data, which is
+// in row-major order.
+func NewMatNDFromFloat64s(sizes []int, data []float64) (*MatND, error) {
+	if n := totalSize(sizes); len(data) != n {
+		return nil, fmt.Errorf("cv: NewMatNDFromFloat64s: got %d values for %d elements", len(data), n)
+	}
+	m, err := NewMatND(sizes, CV_64FC1)
+	if err != nil {
+		return nil, err
+	}
+	copy(m.float64s(), data)
+	return m, nil
+}
+
+func (m *MatND) arr() unsafe.Pointer {
+	return unsafe.Pointer(m.m)
+}
+
+// Dims returns the number of dimensions in the matrix.
+func (m *MatND) Dims() int {
+	return int(m.m.dims)
+}
+
+// Sizes returns the size of each of the matrix's dimensions.
+func (m *MatND) Sizes() []int {
+	sizes := make([]int, m.Dims())
+	for i := range sizes {
+		sizes[i] = int(m.m.dim[i].size)
+	}
+	return sizes
+}
+
+// Type returns the matrix's element type.
+func (m *MatND) Type() MatType {
+	return MatType(m.m._type & C.CV_MAT_TYPE_MASK)
+}
+
+// Size returns the sizes of the matrix's first two dimensions as a height and
+// width.
+func (m *MatND) Size() Size {
+	return ndSize(m.Sizes())
+}
+
+// Float64s returns a copy of the matrix's elements in row-major order.
+// Channels are interleaved.
+func (m *MatND) Float64s() ([]float64, error) {
+	// The elements are read from C memory after the last use of m.
+	defer runtime.KeepAlive(m)
+	src := m
+	if m.Type()&C.CV_MAT_DEPTH_MASK != C.CV_64F {
+		var err error
+		src, err = NewMatND(m.Sizes(), CV_64FC1.withChannels(m.Type().Channels()))
+		if err != nil {
+			return nil, err
+		}
+		defer src.Release()
+		if err := ConvertScale(m, src, 1, 0); err != nil {
+			return nil, err
+		}
+	}
+	return append([]float64(nil), src.float64s()...), nil
+}
+
+// float64s returns the elements of a CV_64F matrix without copying.
+func (m *MatND) float64s() []float64 {
+	n := totalSize(m.Sizes()) * m.Type().Channels()
+	ptr := *(*unsafe.Pointer)(unsafe.Pointer(&m.m.data))
+	return float64s(cBytes(ptr, n*8))
+}
+
+// Release destroys the memory associated with the matrix.  The matrix must not
+// be used after it is released, but calling Release again is a no-op.
+func (m *MatND) Release() {
+	runtime.SetFinalizer(m, nil)
+	do(m.release)
+}
+
+func (m *MatND) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.m != nil {
+		C.cvReleaseMatND(&m.m)
+	}
+}
+
+func (m *MatND) finalize() {
+	releaseLater(m.release)
+}
+
+// SparseMat is a sparse n-dimensional OpenCV matrix that only stores its
+// non-zero elements.  Matrices are released automatically when they are
+// garbage collected, but Release may be called to free the matrix's memory
+// sooner.
+type SparseMat struct {
+	// mu is held while the matrix is being released.
+	mu sync.Mutex
+	m  *C.CvSparseMat
+}
+
+// SparseNode is a non-zero element of a sparse matrix.
+type SparseNode struct {
+	Index []int
+	Value Scalar
+}
+
+// NewSparseMat creates a new, empty sparse matrix with the given size in each
+// dimension.
+func NewSparseMat(sizes []int, typ MatType) (*SparseMat, error) {
+	csizes, err := cSizes(sizes)
+	if err != nil {
+		return nil, err
+	}
+	if err := checkMatType(typ); err != nil {
+		return nil, fmt.Errorf("cv: NewSparseMat: %v", err)
+	}
+	var m *C.CvSparseMat
+	err = doErr(func() error {
+		m = C.try_cvCreateSparseMat(C.int(len(sizes)), &csizes[0], C.int(typ))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	mat := &SparseMat{m: m}
+	runtime.SetFinalizer(mat, (*SparseMat).finalize)
+	return mat, nil
+}
+
+// NewSparseMatFromNodes creates a sparse matrix holding the given elements.
+// Each node's index must have one entry for each of sizes, and later nodes
+// replace earlier ones with the same index.  Unlike NewSparseMatFromFloat64s,
+// this never allocates memory for the zero elements, so it suits large feature
+// spaces like multi-dimensional histograms.
+func NewSparseMatFromNodes(sizes []int, typ MatType, nodes []SparseNode) (*SparseMat, error) {
+	for i, n := range nodes {
+		if len(n.Index) != len(sizes) {
+			return nil, fmt.Errorf("cv: NewSparseMatFromNodes: node %d has %d indices for %d dimensions", i, len(n.Index), len(sizes))
+		}
+		for j := range sizes {
+			if n.Index[j] < 0 || n.Index[j] >= sizes[j] {
+				return nil, fmt.Errorf("cv: NewSparseMatFromNodes: node %d index %v out of range for matrix of size %v", i, n.Index, sizes)
+			}
+		}
+	}
+	m, err := NewSparseMat(sizes, typ)
+	if err != nil {
+		return nil, err
+	}
+	idx := make([]C.int, len(sizes))
+	err = doErr(func() error {
+		for _, n := range nodes {
+			for j := range idx {
+				idx[j] = C.int(n.Index[j])
+			}
+			C.try_cvSetND(m.arr(), &idx[0], n.Value.cvScalar())
+		}
+		return nil
+	})
+	if err != nil {
+		m.Release()
+		return nil, err
+	}
+	return m, nil
+}
+
+// NewSparseMatFromFloat64s creates a CV_64FC1 sparse matrix from the non-zero
+// values in data, which is in row-major order.  NewSparseMatFromNodes avoids
+// the dense slice for large matrices.
+func NewSparseMatFromFloat64s(sizes []int, data []float64) (*SparseMat, error) {
+	if n := totalSize(sizes); len(data) != n {
+		return nil, fmt.Errorf("cv: NewSparseMatFromFloat64s: got %d values for %d elements", len(data), n)
+	}
+	m, err := NewSparseMat(sizes, CV_64FC1)
+	if err != nil {
+		return nil, err
+	}
+	idx := make([]C.int, len(sizes))
+	err = doErr(func() error {
+		for i, v := range data {
+			if v == 0 {
+				continue
+			}
+			for j, k := len(sizes)-1, i; j >= 0; j-- {
+				idx[j] = C.int(k % sizes[j])
+				k /= sizes[j]
+			}
+			C.try_cvSetRealND(m.arr(), &idx[0], C.double(v))
+		}
+		return nil
+	})
+	if err != nil {
+		m.Release()
+		return nil, err
+	}
+	return m, nil
+}
+
+func (m *SparseMat) arr() unsafe.Pointer {
+	return unsafe.Pointer(m.m)
+}
+
+// Dims returns the number of dimensions in the matrix.
+func (m *SparseMat) Dims() int {
+	return int(m.m.dims)
+}
+
+// Sizes returns the size of each of the matrix's dimensions.
+func (m *SparseMat) Sizes() []int {
+	sizes := make([]int, m.Dims())
+	for i := range sizes {
+		sizes[i] = int(m.m.size[i])
+	}
+	return sizes
+}
+
+// Type returns the matrix's element type.
+func (m *SparseMat) Type() MatType {
+	return MatType(m.m._type & C.CV_MAT_TYPE_MASK)
+}
+
+// Size returns the sizes of the matrix's first two dimensions as a height and
+// width.
+func (m *SparseMat) Size() Size {
+	return ndSize(m.Sizes())
+}
+
+// Nodes returns the matrix's non-zero elements in no particular order.
+func (m *SparseMat) Nodes() []SparseNode {
+	var nodes []SparseNode
+	dims, typ := m.Dims(), C.int(m.Type())
+	do(func() {
+		var it C.CvSparseMatIterator
+		for node := C.cvInitSparseMatIterator(m.m, &it); node != nil; node = C.cvGetNextSparseNode(&it) {
+			// These are the CV_NODE_IDX and CV_NODE_VAL macros.
+			idx := (*[C.CV_MAX_DIM]C.int)(unsafe.Pointer(uintptr(unsafe.Pointer(node)) + uintptr(m.m.idxoffset)))
+			val := unsafe.Pointer(uintptr(unsafe.Pointer(node)) + uintptr(m.m.valoffset))
+
+			var s C.CvScalar
+			C.cvRawDataToScalar(val, typ, &s)
+			n := SparseNode{Index: make([]int, dims), Value: scalarFromC(s)}
+			for i := range n.Index {
+				n.Index[i] = int(idx[i])
+			}
+			nodes = append(nodes, n)
+		}
+	})
+	return nodes
+}
+
+// Float64s returns a dense copy of the matrix's elements in row-major order.
+// Channels are interleaved.  Nodes avoids allocating the zero elements for
+// large matrices.
+func (m *SparseMat) Float64s() []float64 {
+	sizes, cn := m.Sizes(), m.Type().Channels()
+	data := make([]float64, totalSize(sizes)*cn)
+	for _, n := range m.Nodes() {
+		i := 0
+		for j := range sizes {
+			i = i*sizes[j] + n.Index[j]
+		}
+		copy(data[i*cn:(i+1)*cn], n.Value[:cn])
+	}
+	return data
+}
+
+// Release destroys the memory associated with the matrix.  The matrix must not
+// be used after it is released, but calling Release again is a no-op.
+func (m *SparseMat) Release() {
+	runtime.SetFinalizer(m, nil)
+	do(m.release)
+}
+
+func (m *SparseMat) release() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.m != nil {
+		C.cvReleaseSparseMat(&m.m)
+	}
+}
+
+func (m *SparseMat) finalize() {
+	releaseLater(m.release)
+}
+
+// cSizes validates the dimension sizes of an n-dimensional matrix and converts
+// them to C ints.
+func cSizes(sizes []int) ([]C.int, error) {
+	if len(sizes) == 0 || len(sizes) > C.CV_MAX_DIM {
+		return nil, fmt.Errorf("cv: matrix must have between 1 and %d dimensions", C.CV_MAX_DIM)
+	}
+	csizes := make([]C.int, len(sizes))
+	for i, n := range sizes {
+		if n <= 0 {
+			return nil, errors.New("cv: matrix dimensions must be positive")
+		}
+		csizes[i] = C.int(n)
+	}
+	return csizes, nil
+}
+
+// totalSize returns the number of elements in a matrix with the given
+// dimension sizes.
+func totalSize(sizes []int) int {
+	n := 1
+	for _, s := range sizes {
+		n *= s
+	}
+	return n
+}
+
+// ndSize returns the first two of sizes as a Size.
+func ndSize(sizes []int) Size {
+	switch len(sizes) {
+	case 0:
+		return Size{}
+	case 1:
+		return Size{1, sizes[0]}
+	default:
+		return Size{sizes[1], sizes[0]}
+	}
+}
@@ -10,6 +10,8 @@ import (
 // Seq is a generic OpenCV sequence.
 type Seq struct {
 	seq *C.CvSeq
+	// storage keeps the pool that the sequence was allocated from reachable.
+	storage *MemStorage
 }
 
 // Len returns the number of items in the sequence.
@@ -23,12 +25,12 @@ func (s Seq) IsZero() bool {
 
 // Prev returns the previous linked sequence.
 func (s Seq) Prev() Seq {
-	return Seq{(*C.CvSeq)(s.seq.h_prev)}
+	return Seq{(*C.CvSeq)(s.seq.h_prev), s.storage}
 }
 
 // Next returns the next linked sequence.
 func (s Seq) Next() Seq {
-	return Seq{(*C.CvSeq)(s.seq.h_next)}
+	return Seq{(*C.CvSeq)(s.seq.h_next), s.storage}
 }
 
 // At returns the element at i.
@@ -0,0 +1,433 @@
+#include <exception>
+#include <string.h>
+
+#include <opencv2/core/core.hpp>
+
+#include "shim.h"
+
+// The last error caught on this thread.  Only the first error is kept, since
+// later ones are usually caused by it.
+static __thread int errStatus;
+static __thread int errLine;
+static __thread char errFunc[128];
+static __thread char errFile[256];
+static __thread char errMsg[1024];
+
+static void copyString(char *dst, size_t n, const char *src) {
+	strncpy(dst, src, n-1);
+	dst[n-1] = '\0';
+}
+
+static void setError(int status, const char *func, const char *msg, const char *file, int line) {
+	if (errStatus != 0) {
+		return;
+	}
+	errStatus = status;
+	errLine = line;
+	copyString(errFunc, sizeof(errFunc), func);
+	copyString(errFile, sizeof(errFile), file);
+	copyString(errMsg, sizeof(errMsg), msg);
+}
+
+// silentError stops OpenCV from printing errors to stderr before throwing them.
+static int silentError(int, const char *, const char *, const char *, int, void *) {
+	return 0;
+}
+
+void installErrorHandler(void) {
+	cvRedirectError(silentError, NULL, NULL);
+}
+
+void clearError(void) {
+	errStatus = 0;
+}
+
+int getErrStatus(void) { return errStatus; }
+int getErrLine(void) { return errLine; }
+const char *getErrFunc(void) { return errFunc; }
+const char *getErrFile(void) { return errFile; }
+const char *getErrMsg(void) { return errMsg; }
+
+// TRY runs stmt and records any exception it throws.
+#define TRY(stmt) \
+	try { \
+		stmt; \
+	} catch (const cv::Exception &e) { \
+		setError(e.code, e.func.c_str(), e.err.c_str(), e.file.c_str(), e.line); \
+	} catch (const std::exception &e) { \
+		setError(CV_StsError, "", e.what(), "", 0); \
+	} catch (...) { \
+		setError(CV_StsError, "", "unknown exception", "", 0); \
+	}
+
+// Arrays
+
+void try_cvCopy(const CvArr *src, CvArr *dst, const CvArr *mask) {
+	TRY(cvCopy(src, dst, mask));
+}
+
+void try_cvConvertScale(const CvArr *src, CvArr *dst, double scale, double shift) {
+	TRY(cvConvertScale(src, dst, scale, shift));
+}
+
+int try_cvGetElemType(const CvArr *arr) {
+	int t = -1;
+	TRY(t = cvGetElemType(arr));
+	return t;
+}
+
+int try_cvGetDims(const CvArr *arr, int *sizes) {
+	int n = 0;
+	TRY(n = cvGetDims(arr, sizes));
+	return n;
+}
+
+CvScalar try_cvGet1D(const CvArr *arr, int idx0) {
+	CvScalar s = cvScalarAll(0);
+	TRY(s = cvGet1D(arr, idx0));
+	return s;
+}
+
+CvScalar try_cvGet2D(const CvArr *arr, int idx0, int idx1) {
+	CvScalar s = cvScalarAll(0);
+	TRY(s = cvGet2D(arr, idx0, idx1));
+	return s;
+}
+
+CvScalar try_cvGet3D(const CvArr *arr, int idx0, int idx1, int idx2) {
+	CvScalar s = cvScalarAll(0);
+	TRY(s = cvGet3D(arr, idx0, idx1, idx2));
+	return s;
+}
+
+CvScalar try_cvGetND(const CvArr *arr, const int *idx) {
+	CvScalar s = cvScalarAll(0);
+	TRY(s = cvGetND(arr, idx));
+	return s;
+}
+
+double try_cvGetReal1D(const CvArr *arr, int idx0) {
+	double v = 0;
+	TRY(v = cvGetReal1D(arr, idx0));
+	return v;
+}
+
+double try_cvGetReal2D(const CvArr *arr, int idx0, int idx1) {
+	double v = 0;
+	TRY(v = cvGetReal2D(arr, idx0, idx1));
+	return v;
+}
+
+double try_cvGetReal3D(const CvArr *arr, int idx0, int idx1, int idx2) {
+	double v = 0;
+	TRY(v = cvGetReal3D(arr, idx0, idx1, idx2));
+	return v;
+}
+
+double try_cvGetRealND(const CvArr *arr, const int *idx) {
+	double v = 0;
+	TRY(v = cvGetRealND(arr, idx));
+	return v;
+}
+
+void try_cvSet1D(CvArr *arr, int idx0, CvScalar value) {
+	TRY(cvSet1D(arr, idx0, value));
+}
+
+void try_cvSet2D(CvArr *arr, int idx0, int idx1, CvScalar value) {
+	TRY(cvSet2D(arr, idx0, idx1, value));
+}
+
+void try_cvSet3D(CvArr *arr, int idx0, int idx1, int idx2, CvScalar value) {
+	TRY(cvSet3D(arr, idx0, idx1, idx2, value));
+}
+
+void try_cvSetND(CvArr *arr, const int *idx, CvScalar value) {
+	TRY(cvSetND(arr, idx, value));
+}
+
+void try_cvSetReal1D(CvArr *arr, int idx0, double value) {
+	TRY(cvSetReal1D(arr, idx0, value));
+}
+
+void try_cvSetReal2D(CvArr *arr, int idx0, int idx1, double value) {
+	TRY(cvSetReal2D(arr, idx0, idx1, value));
+}
+
+void try_cvSetReal3D(CvArr *arr, int idx0, int idx1, int idx2, double value) {
+	TRY(cvSetReal3D(arr, idx0, idx1, idx2, value));
+}
+
+void try_cvSetRealND(CvArr *arr, const int *idx, double value) {
+	TRY(cvSetRealND(arr, idx, value));
+}
+
+void try_cvSetData(CvArr *arr, void *data, int step) {
+	TRY(cvSetData(arr, data, step));
+}
+
+void try_cvSetImageROI(IplImage *image, CvRect rect) {
+	TRY(cvSetImageROI(image, rect));
+}
+
+CvMat *try_cvCreateMat(int rows, int cols, int type) {
+	CvMat *m = NULL;
+	TRY(m = cvCreateMat(rows, cols, type));
+	return m;
+}
+
+CvMat *try_cvGetMat(const CvArr *arr, CvMat *header, int *coi, int allowND) {
+	CvMat *m = NULL;
+	TRY(m = cvGetMat(arr, header, coi, allowND));
+	return m;
+}
+
+CvMatND *try_cvCreateMatND(int dims, const int *sizes, int type) {
+	CvMatND *m = NULL;
+	TRY(m = cvCreateMatND(dims, sizes, type));
+	return m;
+}
+
+CvSparseMat *try_cvCreateSparseMat(int dims, const int *sizes, int type) {
+	CvSparseMat *m = NULL;
+	TRY(m = cvCreateSparseMat(dims, sizes, type));
+	return m;
+}
+
+// Arithmetic and logic
+
+void try_cvAdd(const CvArr *src1, const CvArr *src2, CvArr *dst, const CvArr *mask) {
+	TRY(cvAdd(src1, src2, dst, mask));
+}
+
+void try_cvAddS(const CvArr *src, CvScalar value, CvArr *dst, const CvArr *mask) {
+	TRY(cvAddS(src, value, dst, mask));
+}
+
+void try_cvAddWeighted(const CvArr *src1, double alpha, const CvArr *src2, double beta, double gamma, CvArr *dst) {
+	TRY(cvAddWeighted(src1, alpha, src2, beta, gamma, dst));
+}
+
+void try_cvSub(const CvArr *src1, const CvArr *src2, CvArr *dst, const CvArr *mask) {
+	TRY(cvSub(src1, src2, dst, mask));
+}
+
+void try_cvSubS(const CvArr *src, CvScalar value, CvArr *dst, const CvArr *mask) {
+	TRY(cvSubS(src, value, dst, mask));
+}
+
+void try_cvSubRS(const CvArr *src, CvScalar value, CvArr *dst, const CvArr *mask) {
+	TRY(cvSubRS(src, value, dst, mask));
+}
+
+void try_cvMul(const CvArr *src1, const CvArr *src2, CvArr *dst, double scale) {
+	TRY(cvMul(src1, src2, dst, scale));
+}
+
+void try_cvDiv(const CvArr *src1, const CvArr *src2, CvArr *dst, double scale) {
+	TRY(cvDiv(src1, src2, dst, scale));
+}
+
+void try_cvAbsDiff(const CvArr *src1, const CvArr *src2, CvArr *dst) {
+	TRY(cvAbsDiff(src1, src2, dst));
+}
+
+void try_cvAbsDiffS(const CvArr *src, CvArr *dst, CvScalar value) {
+	TRY(cvAbsDiffS(src, dst, value));
+}
+
+void try_cvAnd(const CvArr *src1, const CvArr *src2, CvArr *dst, const CvArr *mask) {
+	TRY(cvAnd(src1, src2, dst, mask));
+}
+
+void try_cvAndS(const CvArr *src, CvScalar value, CvArr *dst, const CvArr *mask) {
+	TRY(cvAndS(src, value, dst, mask));
+}
+
+void try_cvOr(const CvArr *src1, const CvArr *src2, CvArr *dst, const CvArr *mask) {
+	TRY(cvOr(src1, src2, dst, mask));
+}
+
+void try_cvOrS(const CvArr *src, CvScalar value, CvArr *dst, const CvArr *mask) {
+	TRY(cvOrS(src, value, dst, mask));
+}
+
+void try_cvXor(const CvArr *src1, const CvArr *src2, CvArr *dst, const CvArr *mask) {
+	TRY(cvXor(src1, src2, dst, mask));
+}
+
+void try_cvXorS(const CvArr *src, CvScalar value, CvArr *dst, const CvArr *mask) {
+	TRY(cvXorS(src, value, dst, mask));
+}
+
+void try_cvNot(const CvArr *src, CvArr *dst) {
+	TRY(cvNot(src, dst));
+}
+
+void try_cvCmp(const CvArr *src1, const CvArr *src2, CvArr *dst, int op) {
+	TRY(cvCmp(src1, src2, dst, op));
+}
+
+void try_cvCmpS(const CvArr *src, double value, CvArr *dst, int op) {
+	TRY(cvCmpS(src, value, dst, op));
+}
+
+void try_cvInRange(const CvArr *src, const CvArr *lower, const CvArr *upper, CvArr *dst) {
+	TRY(cvInRange(src, lower, upper, dst));
+}
+
+void try_cvInRangeS(const CvArr *src, CvScalar lower, CvScalar upper, CvArr *dst) {
+	TRY(cvInRangeS(src, lower, upper, dst));
+}
+
+// Image processing
+
+double try_cvThreshold(const CvArr *src, CvArr *dst, double thresh, double maxVal, int type) {
+	double r = 0;
+	TRY(r = cvThreshold(src, dst, thresh, maxVal, type));
+	return r;
+}
+
+void try_cvCvtColor(const CvArr *src, CvArr *dst, int code) {
+	TRY(cvCvtColor(src, dst, code));
+}
+
+void try_cvSplit(const CvArr *src, CvArr *dst0, CvArr *dst1, CvArr *dst2, CvArr *dst3) {
+	TRY(cvSplit(src, dst0, dst1, dst2, dst3));
+}
+
+void try_cvPyrDown(const CvArr *src, CvArr *dst, int filter) {
+	TRY(cvPyrDown(src, dst, filter));
+}
+
+void try_cvPyrUp(const CvArr *src, CvArr *dst, int filter) {
+	TRY(cvPyrUp(src, dst, filter));
+}
+
+void try_cvDilate(const CvArr *src, CvArr *dst, IplConvKernel *element, int iterations) {
+	TRY(cvDilate(src, dst, element, iterations));
+}
+
+void try_cvErode(const CvArr *src, CvArr *dst, IplConvKernel *element, int iterations) {
+	TRY(cvErode(src, dst, element, iterations));
+}
+
+void try_cvMorphologyEx(const CvArr *src, CvArr *dst, CvArr *temp, IplConvKernel *element, int operation, int iterations) {
+	TRY(cvMorphologyEx(src, dst, temp, element, operation, iterations));
+}
+
+// Contours
+
+int try_cvFindContours(CvArr *image, CvMemStorage *storage, CvSeq **first, int headerSize, int mode, int method, CvPoint offset) {
+	int n = -1;
+	TRY(n = cvFindContours(image, storage, first, headerSize, mode, method, offset));
+	return n;
+}
+
+CvSeq *try_cvApproxPoly(const void *srcSeq, int headerSize, CvMemStorage *storage, int method, double eps, int recursive) {
+	CvSeq *seq = NULL;
+	TRY(seq = cvApproxPoly(srcSeq, headerSize, storage, method, eps, recursive));
+	return seq;
+}
+
+double try_cvContourArea(const CvArr *contour, CvSlice slice, int oriented) {
+	double area = 0;
+	TRY(area = cvContourArea(contour, slice, oriented));
+	return area;
+}
+
+double try_cvArcLength(const void *curve, CvSlice slice, int isClosed) {
+	double length = 0;
+	TRY(length = cvArcLength(curve, slice, isClosed));
+	return length;
+}
+
+CvSeq *try_cvConvexHull2(const CvArr *input, void *hullStorage, int orientation, int returnPoints) {
+	CvSeq *seq = NULL;
+	TRY(seq = cvConvexHull2(input, hullStorage, orientation, returnPoints));
+	return seq;
+}
+
+int try_cvCheckContourConvexity(const CvArr *contour) {
+	int r = 0;
+	TRY(r = cvCheckContourConvexity(contour));
+	return r;
+}
+
+CvRect try_cvBoundingRect(CvArr *points, int update) {
+	CvRect r = cvRect(0, 0, 0, 0);
+	TRY(r = cvBoundingRect(points, update));
+	return r;
+}
+
+// Persistence
+
+CvFileStorage *try_cvOpenFileStorage(const char *filename, CvMemStorage *storage, int flags, const char *encoding) {
+	CvFileStorage *fs = NULL;
+	TRY(fs = cvOpenFileStorage(filename, storage, flags, encoding));
+	return fs;
+}
+
+void try_cvReleaseFileStorage(CvFileStorage **fs) {
+	TRY(cvReleaseFileStorage(fs));
+}
+
+void *try_cvLoad(const char *filename, CvMemStorage *storage, const char *name, const char **realName) {
+	void *ptr = NULL;
+	TRY(ptr = cvLoad(filename, storage, name, realName));
+	return ptr;
+}
+
+void try_cvSave(const char *filename, const void *obj, const char *name, const char *comment, CvAttrList attributes) {
+	TRY(cvSave(filename, obj, name, comment, attributes));
+}
+
+void try_cvWriteInt(CvFileStorage *fs, const char *name, int value) {
+	TRY(cvWriteInt(fs, name, value));
+}
+
+void try_cvWriteReal(CvFileStorage *fs, const char *name, double value) {
+	TRY(cvWriteReal(fs, name, value));
+}
+
+void try_cvWriteString(CvFileStorage *fs, const char *name, const char *str, int quote) {
+	TRY(cvWriteString(fs, name, str, quote));
+}
+
+void try_cvWriteComment(CvFileStorage *fs, const char *comment, int eolComment) {
+	TRY(cvWriteComment(fs, comment, eolComment));
+}
+
+void try_cvStartWriteStruct(CvFileStorage *fs, const char *name, int flags, const char *typeName, CvAttrList attributes) {
+	TRY(cvStartWriteStruct(fs, name, flags, typeName, attributes));
+}
+
+void try_cvEndWriteStruct(CvFileStorage *fs) {
+	TRY(cvEndWriteStruct(fs));
+}
+
+void try_cvWrite(CvFileStorage *fs, const char *name, const void *ptr, CvAttrList attributes) {
+	TRY(cvWrite(fs, name, ptr, attributes));
+}
+
+// Image files
+
+int try_cvSaveImage(const char *filename, const CvArr *image, const int *params) {
+	int r = 0;
+	TRY(r = cvSaveImage(filename, image, params));
+	return r;
+}
+
+CvMat *try_cvEncodeImage(const char *ext, const CvArr *image, const int *params) {
+	CvMat *m = NULL;
+	TRY(m = cvEncodeImage(ext, image, params));
+	return m;
+}
+
+// Capture
+
+IplImage *try_cvQueryFrame(CvCapture *capture) {
+	IplImage *image = NULL;
+	TRY(image = cvQueryFrame(capture));
+	return image;
+}
@@ -0,0 +1,120 @@
+// OpenCV 2.4 reports errors by throwing C++ exceptions, even from its C API.
+// An exception that reaches a cgo call aborts the process, so every OpenCV
+// call that can fail is made through one of the try_ functions below.  They
+// catch the exception and record it for the calling thread, where takeError
+// picks it up.
+
+#ifndef GOCV_SHIM_H
+#define GOCV_SHIM_H
+
+#include "cv.h"
+#include "highgui.h"
+
+#ifdef __cplusplus
+extern "C" {
+#endif
+
+// Error state of the calling thread.
+void installErrorHandler(void);
+void clearError(void);
+int getErrStatus(void);
+int getErrLine(void);
+const char *getErrFunc(void);
+const char *getErrFile(void);
+const char *getErrMsg(void);
+
+// Arrays
+void try_cvCopy(const CvArr *src, CvArr *dst, const CvArr *mask);
+void try_cvConvertScale(const CvArr *src, CvArr *dst, double scale, double shift);
+int try_cvGetElemType(const CvArr *arr);
+int try_cvGetDims(const CvArr *arr, int *sizes);
+CvScalar try_cvGet1D(const CvArr *arr, int idx0);
+CvScalar try_cvGet2D(const CvArr *arr, int idx0, int idx1);
+CvScalar try_cvGet3D(const CvArr *arr, int idx0, int idx1, int idx2);
+CvScalar try_cvGetND(const CvArr *arr, const int *idx);
+double try_cvGetReal1D(const CvArr *arr, int idx0);
+double try_cvGetReal2D(const CvArr *arr, int idx0, int idx1);
+double try_cvGetReal3D(const CvArr *arr, int idx0, int idx1, int idx2);
+double try_cvGetRealND(const CvArr *arr, const int *idx);
+void try_cvSet1D(CvArr *arr, int idx0, CvScalar value);
+void try_cvSet2D(CvArr *arr, int idx0, int idx1, CvScalar value);
+void try_cvSet3D(CvArr *arr, int idx0, int idx1, int idx2, CvScalar value);
+void try_cvSetND(CvArr *arr, const int *idx, CvScalar value);
+void try_cvSetReal1D(CvArr *arr, int idx0, double value);
+void try_cvSetReal2D(CvArr *arr, int idx0, int idx1, double value);
+void try_cvSetReal3D(CvArr *arr, int idx0, int idx1, int idx2, double value);
+void try_cvSetRealND(CvArr *arr, const int *idx, double value);
+void try_cvSetData(CvArr *arr, void *data, int step);
+void try_cvSetImageROI(IplImage *image, CvRect rect);
+CvMat *try_cvCreateMat(int rows, int cols, int type);
+CvMat *try_cvGetMat(const CvArr *arr, CvMat *header, int *coi, int allowND);
+CvMatND *try_cvCreateMatND(int dims, const int *sizes, int type);
+CvSparseMat *try_cvCreateSparseMat(int dims, const int *sizes, int type);
+
+// Arithmetic and logic
+void try_cvAdd(const CvArr *src1, const CvArr *src2, CvArr *dst, const CvArr *mask);
+void try_cvAddS(const CvArr *src, CvScalar value, CvArr *dst, const CvArr *mask);
+void try_cvAddWeighted(const CvArr *src1, double alpha, const CvArr *src2, double beta, double gamma, CvArr *dst);
+void try_cvSub(const CvArr *src1, const CvArr *src2, CvArr *dst, const CvArr *mask);
+void try_cvSubS(const CvArr *src, CvScalar value, CvArr *dst, const CvArr *mask);
+void try_cvSubRS(const CvArr *src, CvScalar value, CvArr *dst, const CvArr *mask);
+void try_cvMul(const CvArr *src1, const CvArr *src2, CvArr *dst, double scale);
+void try_cvDiv(const CvArr *src1, const CvArr *src2, CvArr *dst, double scale);
+void try_cvAbsDiff(const CvArr *src1, const CvArr *src2, CvArr *dst);
+void try_cvAbsDiffS(const CvArr *src, CvArr *dst, CvScalar value);
+void try_cvAnd(const CvArr *src1, const CvArr *src2, CvArr *dst, const CvArr *mask);
+void try_cvAndS(const CvArr *src, CvScalar value, CvArr *dst, const CvArr *mask);
+void try_cvOr(const CvArr *src1, const CvArr *src2, CvArr *dst, const CvArr *mask);
+void try_cvOrS(const CvArr *src, CvScalar value, CvArr *dst, const CvArr *mask);
+void try_cvXor(const CvArr *src1, const CvArr *src2, CvArr *dst, const CvArr *mask);
+void try_cvXorS(const CvArr *src, CvScalar value, CvArr *dst, const CvArr *mask);
+void try_cvNot(const CvArr *src, CvArr *dst);
+void try_cvCmp(const CvArr *src1, const CvArr *src2, CvArr *dst, int op);
+void try_cvCmpS(const CvArr *src, double value, CvArr *dst, int op);
+void try_cvInRange(const CvArr *src, const CvArr *lower, const CvArr *upper, CvArr *dst);
+void try_cvInRangeS(const CvArr *src, CvScalar lower, CvScalar upper, CvArr *dst);
+
+// Image processing
+double try_cvThreshold(const CvArr *src, CvArr *dst, double thresh, double maxVal, int type);
+void try_cvCvtColor(const CvArr *src, CvArr *dst, int code);
+void try_cvSplit(const CvArr *src, CvArr *dst0, CvArr *dst1, CvArr *dst2, CvArr *dst3);
+void try_cvPyrDown(const CvArr *src, CvArr *dst, int filter);
+void try_cvPyrUp(const CvArr *src, CvArr *dst, int filter);
+void try_cvDilate(const CvArr *src, CvArr *dst, IplConvKernel *element, int iterations);
+void try_cvErode(const CvArr *src, CvArr *dst, IplConvKernel *element, int iterations);
+void try_cvMorphologyEx(const CvArr *src, CvArr *dst, CvArr *temp, IplConvKernel *element, int operation, int iterations);
+
+// Contours
+int try_cvFindContours(CvArr *image, CvMemStorage *storage, CvSeq **first, int headerSize, int mode, int method, CvPoint offset);
+CvSeq *try_cvApproxPoly(const void *srcSeq, int headerSize, CvMemStorage *storage, int method, double eps, int recursive);
+double try_cvContourArea(const CvArr *contour, CvSlice slice, int oriented);
+double try_cvArcLength(const void *curve, CvSlice slice, int isClosed);
+CvSeq *try_cvConvexHull2(const CvArr *input, void *hullStorage, int orientation, int returnPoints);
+int try_cvCheckContourConvexity(const CvArr *contour);
+CvRect try_cvBoundingRect(CvArr *points, int update);
+
+// Persistence
+CvFileStorage *try_cvOpenFileStorage(const char *filename, CvMemStorage *storage, int flags, const char *encoding);
+void try_cvReleaseFileStorage(CvFileStorage **fs);
+void *try_cvLoad(const char *filename, CvMemStorage *storage, const char *name, const char **realName);
+void try_cvSave(const char *filename, const void *obj, const char *name, const char *comment, CvAttrList attributes);
+void try_cvWriteInt(CvFileStorage *fs, const char *name, int value);
+void try_cvWriteReal(CvFileStorage *fs, const char *name, double value);
+void try_cvWriteString(CvFileStorage *fs, const char *name, const char *str, int quote);
+void try_cvWriteComment(CvFileStorage *fs, const char *comment, int eolComment);
+void try_cvStartWriteStruct(CvFileStorage *fs, const char *name, int flags, const char *typeName, CvAttrList attributes);
+void try_cvEndWriteStruct(CvFileStorage *fs);
+void try_cvWrite(CvFileStorage *fs, const char *name, const void *ptr, CvAttrList attributes);
+
+// Image files
+int try_cvSaveImage(const char *filename, const CvArr *image, const int *params);
+CvMat *try_cvEncodeImage(const char *ext, const CvArr *image, const int *params);
+
+// Capture
+IplImage *try_cvQueryFrame(CvCapture *capture);
+
+#ifdef __cplusplus
+}
+#endif
+
+#endif
@@ -3,24 +3,46 @@ package cv
 // #include "cv.h"
 import "C"
 
-// MemStorage is an OpenCV memory pool.
+import (
+	"runtime"
+	"sync"
+)
+
+// MemStorage is an OpenCV memory pool.  Storage is released automatically when
+// it is garbage collected, but Release may be called to free it sooner.
 type MemStorage struct {
-	s *C.CvMemStorage
+	// mu is held while the storage is being released.
+	mu sync.Mutex
+	s  *C.CvMemStorage
 }
 
 // NewMemStorage creates new memory storage. A blockSize of zero uses the
 // default block size.
-func NewMemStorage(blockSize int) MemStorage {
-	var ms MemStorage
+func NewMemStorage(blockSize int) *MemStorage {
+	ms := new(MemStorage)
 	do(func() {
-		ms = MemStorage{C.cvCreateMemStorage(C.int(blockSize))}
+		ms.s = C.cvCreateMemStorage(C.int(blockSize))
 	})
+	runtime.SetFinalizer(ms, (*MemStorage).finalize)
 	return ms
 }
 
-// Release deallocates all of the memory in the pool.
-func (s MemStorage) Release() {
-	do(func() {
+// Release deallocates all of the memory in the pool.  Any sequences allocated
+// from the pool must not be used afterward, but calling Release again is a
+// no-op.
+func (s *MemStorage) Release() {
+	runtime.SetFinalizer(s, nil)
+	do(s.release)
+}
+
+func (s *MemStorage) release() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.s != nil {
 		C.cvReleaseMemStorage(&s.s)
-	})
+	}
+}
+
+func (s *MemStorage) finalize() {
+	releaseLater(s.release)
 }